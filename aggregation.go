@@ -0,0 +1,281 @@
+package tsdmetrics
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// AggregationFunc merges the values of counters and gauges.
+type AggregationFunc int
+
+const (
+	AggregateSum AggregationFunc = iota
+	AggregateMin
+	AggregateMax
+	AggregateAvg
+)
+
+// AggregationRule removes tags from the matching series and merges the ones
+// which then collide into a single series.
+//
+// Counters and gauges are merged with Function. Meters add up their counts
+// and rates. Histograms, IntegerHistograms and SampledTimers merge their
+// samples, so their percentiles are computed on all the values. Timers from
+// metrics.NewTimer keep their samples private: when one of them is merged,
+// only the counts and rates are exported, and a warning is logged. Other
+// metrics are exported unchanged.
+type AggregationRule struct {
+	Match    SeriesMatcher // Matched on the registry name, before relabeling
+	Without  []string      // Tag keys removed
+	Function AggregationFunc
+}
+
+// Aggregation merges series before they are exported, the first matching
+// rule applying to each series. It must not be modified once given to an
+// exporter.
+type Aggregation struct {
+	Rules []AggregationRule
+
+	compiled bool
+	mutex    sync.Mutex
+	warned   map[string]bool // Timers reported as merged without their samples
+}
+
+// Compile checks the patterns of the rules.
+func (a *Aggregation) Compile() error {
+	if a.compiled {
+		return nil
+	}
+	for i := range a.Rules {
+		if err := a.Rules[i].Match.compile(); err != nil {
+			return fmt.Errorf("Aggregation rule %d: %s", i, err)
+		}
+	}
+	a.compiled = true
+	return nil
+}
+
+type metricKind int
+
+const (
+	counterKind metricKind = iota
+	gaugeKind
+	gaugeFloat64Kind
+	histogramKind
+	integerHistogramKind
+	meterKind
+	timerKind
+)
+
+// sampledMetric is implemented by the SampledTimer snapshots.
+type sampledMetric interface {
+	Sample() metrics.Sample
+}
+
+func kindOf(i interface{}) (metricKind, bool) {
+	switch i.(type) {
+	case metrics.Counter:
+		return counterKind, true
+	case metrics.Gauge:
+		return gaugeKind, true
+	case metrics.GaugeFloat64:
+		return gaugeFloat64Kind, true
+	case metrics.Histogram:
+		return histogramKind, true
+	case metrics.Meter:
+		return meterKind, true
+	case metrics.Timer:
+		return timerKind, true
+	case IntegerHistogram:
+		return integerHistogramKind, true
+	}
+	return 0, false
+}
+
+type aggregateKey struct {
+	name string
+	id   TagsID
+	kind metricKind
+}
+
+// aggregateGroup accumulates the series merged into one.
+type aggregateGroup struct {
+	name string
+	tags Tags
+	kind metricKind
+	fn   AggregationFunc
+	n    int
+
+	ival      int64
+	fval      float64
+	count     int64
+	values    []int64
+	rates     meterRates
+	unsampled bool // A merged timer has no sample, only the rates are kept
+}
+
+// aggregate wraps the walk of the due metrics of the registry with the
+// aggregation rules: merged series are reported once the walk is over.
+func (a *Aggregation) aggregate(each func(func(string, TaggedMetric)), logger log.FieldLogger) func(func(string, TaggedMetric)) {
+	return func(fn func(string, TaggedMetric)) {
+		groups := make(map[aggregateKey]*aggregateGroup)
+		var order []*aggregateGroup
+
+		each(func(name string, tm TaggedMetric) {
+			rule := a.rule(name, tm.GetTags())
+			kind, ok := kindOf(tm.GetMetric())
+			if rule == nil || !ok {
+				fn(name, tm)
+				return
+			}
+
+			tags := copyTags(tm.GetTags())
+			for _, k := range rule.Without {
+				delete(tags, k)
+			}
+			key := aggregateKey{name, tags.TagsID(), kind}
+			g, ok := groups[key]
+			if !ok {
+				g = &aggregateGroup{name: name, tags: tags, kind: kind, fn: rule.Function}
+				groups[key] = g
+				order = append(order, g)
+			}
+			g.add(tm.GetMetric())
+		})
+
+		for _, g := range order {
+			if g.unsampled {
+				a.warnUnsampled(g.name, logger)
+			}
+			fn(g.name, &DefaultTaggedMetric{Tags: g.tags, Metric: g.metric()})
+		}
+	}
+}
+
+// warnUnsampled logs once per metric name that timers were merged without
+// their samples.
+func (a *Aggregation) warnUnsampled(name string, logger log.FieldLogger) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.warned[name] {
+		return
+	}
+	if a.warned == nil {
+		a.warned = make(map[string]bool)
+	}
+	a.warned[name] = true
+	logger.Warnf("Timers %s have no sample to merge, only their counts and rates are aggregated: use NewSampledTimer", name)
+}
+
+func (a *Aggregation) rule(name string, tags Tags) *AggregationRule {
+	for i := range a.Rules {
+		if a.Rules[i].Match.Match(name, tags) {
+			return &a.Rules[i]
+		}
+	}
+	return nil
+}
+
+func (g *aggregateGroup) add(i interface{}) {
+	switch metric := i.(type) {
+	case metrics.Counter:
+		g.addInt(metric.Count())
+	case metrics.Gauge:
+		g.addInt(metric.Value())
+	case metrics.GaugeFloat64:
+		g.addFloat(metric.Value())
+	case metrics.Histogram:
+		g.addSample(metric.Snapshot().Sample())
+	case metrics.Meter:
+		m := metric.Snapshot()
+		g.rates.add(m.Count(), m.Rate1(), m.Rate5(), m.Rate15(), m.RateMean())
+	case metrics.Timer:
+		t := metric.Snapshot()
+		if s, ok := t.(sampledMetric); ok {
+			g.addSample(s.Sample())
+		} else {
+			g.unsampled = true
+		}
+		g.rates.add(t.Count(), t.Rate1(), t.Rate5(), t.Rate15(), t.RateMean())
+	case IntegerHistogram:
+		g.addSample(metric.Snapshot().Sample())
+	}
+	g.n++
+}
+
+func (g *aggregateGroup) addInt(v int64) {
+	switch {
+	case g.n == 0:
+		g.ival = v
+	case g.fn == AggregateMin:
+		if v < g.ival {
+			g.ival = v
+		}
+	case g.fn == AggregateMax:
+		if v > g.ival {
+			g.ival = v
+		}
+	default:
+		g.ival += v
+	}
+}
+
+func (g *aggregateGroup) addFloat(v float64) {
+	switch {
+	case g.n == 0:
+		g.fval = v
+	case g.fn == AggregateMin:
+		if v < g.fval {
+			g.fval = v
+		}
+	case g.fn == AggregateMax:
+		if v > g.fval {
+			g.fval = v
+		}
+	default:
+		g.fval += v
+	}
+}
+
+func (g *aggregateGroup) addSample(s metrics.Sample) {
+	g.count += s.Count()
+	g.values = append(g.values, s.Values()...)
+}
+
+// metric returns the merged metric, read-only.
+func (g *aggregateGroup) metric() interface{} {
+	if g.fn == AggregateAvg && g.n > 0 {
+		g.ival /= int64(g.n)
+		g.fval /= float64(g.n)
+	}
+
+	switch g.kind {
+	case counterKind:
+		c := metrics.NewCounter()
+		c.Inc(g.ival)
+		return c
+	case gaugeKind:
+		m := metrics.NewGauge()
+		m.Update(g.ival)
+		return m
+	case gaugeFloat64Kind:
+		m := metrics.NewGaugeFloat64()
+		m.Update(g.fval)
+		return m
+	case histogramKind:
+		return metrics.NewHistogram(metrics.NewSampleSnapshot(g.count, g.values))
+	case integerHistogramKind:
+		return NewIntegerHistogram(metrics.NewSampleSnapshot(g.count, g.values))
+	case meterKind:
+		return &g.rates
+	case timerKind:
+		if g.unsampled {
+			return &timerRates{g.rates}
+		}
+		return &SampledTimer{histogram: metrics.NewHistogram(metrics.NewSampleSnapshot(g.count, g.values)), meter: &g.rates}
+	}
+	return nil
+}
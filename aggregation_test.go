@@ -0,0 +1,77 @@
+package tsdmetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestAggregation(t *testing.T) {
+	r := NewTaggedRegistry()
+	for i, endpoint := range []string{"/a", "/b", "/c"} {
+		c := metrics.NewCounter()
+		c.Inc(int64(i + 1))
+		r.Register("requests", Tags{"service": "api", "endpoint": endpoint}, c)
+
+		g := metrics.NewGauge()
+		g.Update(int64(10 * (i + 1)))
+		r.Register("inflight", Tags{"service": "api", "endpoint": endpoint}, g)
+
+		h := metrics.NewHistogram(metrics.NewUniformSample(100))
+		timer := NewSampledTimer(metrics.NewUniformSample(100))
+		for v := 0; v < 10; v++ {
+			h.Update(int64(100*i + v))
+			timer.Update(time.Duration(100*i + v))
+		}
+		r.Register("size", Tags{"service": "api", "endpoint": endpoint}, h)
+		r.Register("latency", Tags{"service": "api", "endpoint": endpoint}, timer)
+
+		legacy := metrics.NewTimer()
+		legacy.Update(time.Millisecond)
+		legacy.Update(time.Millisecond)
+		r.Register("legacy", Tags{"service": "api", "endpoint": endpoint}, legacy)
+	}
+	r.Register("requests", Tags{"service": "web"}, metrics.NewCounter())
+
+	e := &TaggedOpenTSDB{
+		Registry: r,
+		Aggregation: &Aggregation{Rules: []AggregationRule{
+			{Match: SeriesMatcher{Name: "inflight"}, Without: []string{"endpoint"}, Function: AggregateMax},
+			{Match: SeriesMatcher{Tags: []TagMatcher{{Key: "service", Type: TagEqual, Value: "api"}}}, Without: []string{"endpoint"}},
+		}},
+		Logger: log.New(),
+	}
+	if err := e.Aggregation.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]interface{}{}
+	e.eachJSONPoint(0, func(p *point) {
+		if _, ok := p.tags["endpoint"]; ok {
+			t.Errorf("Expected %s to be aggregated, got tags %v", p.Metric(), p.tags)
+		}
+		values[p.Metric()+" "+p.tags["service"]] = p.Value()
+	})
+
+	for series, expected := range map[string]interface{}{
+		"requests api":      int64(6),
+		"requests web":      int64(0),
+		"inflight api":      int64(30),
+		"size.count api":    int64(30),
+		"size.min api":      int64(0),
+		"size.max api":      int64(209),
+		"latency.count api": int64(30),
+		"latency.max api":   int64(209),
+		"latency.p50 api":   104.5,
+		"legacy.count api":  int64(6),
+	} {
+		if values[series] != expected {
+			t.Errorf("%s: expected %v, got %v", series, expected, values[series])
+		}
+	}
+	if v, ok := values["legacy.p50 api"]; ok {
+		t.Errorf("Expected no percentiles for timers without samples, got %v", v)
+	}
+}
@@ -0,0 +1,186 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultMaxPendingAnnotations is the number of annotations kept while they
+// cannot be delivered when MaxPendingAnnotations is 0.
+const DefaultMaxPendingAnnotations = 1000
+
+// Annotation marks an event such as a deploy or a configuration change on
+// the graphs. It is sent to the /api/annotation endpoint of OpenTSDB.
+type Annotation struct {
+	StartTime   time.Time
+	EndTime     time.Time // Zero for an instant event
+	TSUID       string    // Series annotated, empty for a global annotation
+	Description string
+	Notes       string
+	Custom      map[string]string
+}
+
+// MarshalJSON encodes the annotation the way OpenTSDB expects it.
+func (a Annotation) MarshalJSON() ([]byte, error) {
+	v := struct {
+		StartTime   int64             `json:"startTime"`
+		EndTime     int64             `json:"endTime,omitempty"`
+		TSUID       string            `json:"tsuid,omitempty"`
+		Description string            `json:"description,omitempty"`
+		Notes       string            `json:"notes,omitempty"`
+		Custom      map[string]string `json:"custom,omitempty"`
+	}{
+		StartTime:   a.StartTime.Unix(),
+		TSUID:       a.TSUID,
+		Description: a.Description,
+		Notes:       a.Notes,
+		Custom:      a.Custom,
+	}
+	if !a.EndTime.IsZero() {
+		v.EndTime = a.EndTime.Unix()
+	}
+	return json.Marshal(v)
+}
+
+// annotationQueue holds the annotations waiting for the next flush.
+type annotationQueue struct {
+	mutex   sync.Mutex
+	pending []Annotation
+}
+
+// Annotate queues a for the next flush. Annotations which cannot be delivered
+// are retried at the following flushes, up to MaxPendingAnnotations of them
+// beyond which the oldest are dropped.
+func (t *TaggedOpenTSDB) Annotate(a Annotation) error {
+	if a.StartTime.IsZero() {
+		return errors.New("Annotation without start time")
+	}
+	if !a.EndTime.IsZero() && a.EndTime.Before(a.StartTime) {
+		return fmt.Errorf("Annotation ends before it starts: %s < %s", a.EndTime, a.StartTime)
+	}
+	t.queueAnnotations([]Annotation{a})
+	return nil
+}
+
+// queueAnnotations appends annotations to the queue, dropping the oldest
+// ones over the limit.
+func (t *TaggedOpenTSDB) queueAnnotations(annotations []Annotation) {
+	q := &t.annotations
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.pending = append(q.pending, annotations...)
+	max := t.MaxPendingAnnotations
+	if max <= 0 {
+		max = DefaultMaxPendingAnnotations
+	}
+	if over := len(q.pending) - max; over > 0 {
+		t.Logger.Warnf("Dropping %d annotations over the %d pending ones", over, max)
+		q.pending = append([]Annotation{}, q.pending[over:]...)
+	}
+}
+
+// pendingAnnotations returns the number of annotations waiting to be sent.
+func (t *TaggedOpenTSDB) pendingAnnotations() int {
+	t.annotations.mutex.Lock()
+	defer t.annotations.mutex.Unlock()
+	return len(t.annotations.pending)
+}
+
+// annotationURL returns the endpoint annotations are posted to, which is
+// AnnotationAddr or the /api/annotation endpoint of the server at Addr.
+func (t *TaggedOpenTSDB) annotationURL() (string, error) {
+	if t.AnnotationAddr != "" {
+		return t.AnnotationAddr, nil
+	}
+	if t.Writer != nil || t.Addr == "" {
+		return "", errors.New("No AnnotationAddr to send annotations to")
+	}
+	if t.Format == Tcollector {
+		return "http://" + t.Addr + "/api/annotation", nil
+	}
+	u, err := url.Parse(t.Addr)
+	if err != nil {
+		return "", err
+	}
+	u.Path, u.RawQuery = "/api/annotation", ""
+	return u.String(), nil
+}
+
+// sendAnnotations posts the queued annotations one by one. Those which could
+// not be delivered are queued again, ahead of the ones annotated meanwhile,
+// unless the server refused them.
+func (t *TaggedOpenTSDB) sendAnnotations(ctx context.Context, stats *flushStats) error {
+	q := &t.annotations
+	q.mutex.Lock()
+	annotations := q.pending
+	q.pending = nil
+	q.mutex.Unlock()
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	addr, err := t.annotationURL()
+	if err != nil {
+		t.Logger.Errorf("Dropping %d annotations: %s", len(annotations), err)
+		return err
+	}
+
+	c := http.Client{Timeout: t.FlushInterval}
+	for i, a := range annotations {
+		retry, err := t.postAnnotation(ctx, &c, addr, a)
+		if err == nil {
+			stats.annotations++
+			continue
+		}
+		if retry {
+			q.mutex.Lock()
+			newer := q.pending
+			q.pending = nil
+			q.mutex.Unlock()
+			t.queueAnnotations(append(annotations[i:], newer...))
+			return err
+		}
+		t.Logger.Errorf("Dropping annotation %q: %s", a.Description, err)
+	}
+	return nil
+}
+
+// postAnnotation sends a to addr, telling if it is worth retrying on failure.
+func (t *TaggedOpenTSDB) postAnnotation(ctx context.Context, c *http.Client, addr string, a Annotation) (bool, error) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, addr, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("Unexpected return code sending annotation: %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("Annotation refused with return code %d", resp.StatusCode)
+	}
+}
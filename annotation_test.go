@@ -0,0 +1,89 @@
+package tsdmetrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestAnnotations(t *testing.T) {
+	var mutex sync.Mutex
+	var bodies []string
+	fail := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/annotation" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies = append(bodies, string(b))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	e := &TaggedOpenTSDB{
+		Addr:          ts.URL + "/api/put?details",
+		Registry:      NewTaggedRegistry(),
+		FlushInterval: time.Minute,
+		Format:        Json,
+		Logger:        log.New(),
+	}
+	start := time.Date(2017, 9, 15, 14, 0, 0, 0, time.UTC)
+	err := e.Annotate(Annotation{
+		StartTime:   start,
+		EndTime:     start.Add(5 * time.Minute),
+		Description: "Deploy v1.2",
+		Custom:      map[string]string{"owner": "core"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Annotate(Annotation{StartTime: start, TSUID: "000001000001000001", Description: "Restart"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Annotate(Annotation{Description: "No start"}); err == nil {
+		t.Error("Expected an annotation without start time to be refused")
+	}
+
+	if err := e.Export(); err == nil {
+		t.Error("Expected the failed annotations to fail the flush")
+	}
+	if s := e.Status(); s.PendingAnnotations != 2 {
+		t.Errorf("Expected both annotations to be kept for a retry, got %d", s.PendingAnnotations)
+	}
+
+	mutex.Lock()
+	fail = false
+	mutex.Unlock()
+	res := e.taggedOpenTSDB(context.Background(), start)
+	if res.Err != nil || res.Annotations != 2 || e.Status().PendingAnnotations != 0 {
+		t.Errorf("Unexpected flush after the retry: %+v", res)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	expected := []string{
+		`{"startTime":1505484000,"endTime":1505484300,"description":"Deploy v1.2","custom":{"owner":"core"}}`,
+		`{"startTime":1505484000,"tsuid":"000001000001000001","description":"Restart"}`,
+	}
+	if len(bodies) != len(expected) {
+		t.Fatalf("Expected %d annotations, got %v", len(expected), bodies)
+	}
+	for i := range expected {
+		if bodies[i] != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], bodies[i])
+		}
+	}
+}
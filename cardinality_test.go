@@ -0,0 +1,84 @@
+package tsdmetrics
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestCardinalityLimits(t *testing.T) {
+	r := NewTaggedRegistry().(*DefaultTaggedRegistry)
+	r.SetCardinalityLimits(CardinalityLimits{MaxSeriesPerMetric: 2, MaxSeries: 6, Overflow: Tags{"overflow": "true"}})
+
+	for i := 0; i < 4; i++ {
+		c := r.GetOrRegister("requests", Tags{"user": fmt.Sprint(i)}, metrics.NewCounter).(metrics.Counter)
+		c.Inc(1)
+	}
+	overflow, ok := r.Get("requests", Tags{"overflow": "true"}).(metrics.Counter)
+	if !ok || overflow.Count() != 2 {
+		t.Fatalf("Expected the overflow series to count 2, got %v", overflow)
+	}
+
+	if err := r.Register("requests", Tags{"user": "5"}, metrics.NewCounter()); err == nil {
+		t.Error("Expected registration over a full overflow series to be refused")
+	} else if _, ok := err.(CardinalityLimitExceeded); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Limits counters, 3 requests series, 1 other: the registry is full.
+	if err := r.Register("other", Tags{}, metrics.NewCounter()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("new", Tags{}, metrics.NewCounter()); err == nil {
+		t.Error("Expected a new name over the global limit to be refused")
+	}
+	if err := r.Register("other", Tags{"a": "b"}, metrics.NewCounter()); err != nil {
+		t.Error(err)
+	}
+	if r.Get("other", Tags{"overflow": "true"}) == nil {
+		t.Error("Expected a new tag set over the global limit to overflow")
+	}
+
+	r.Unregister("other", Tags{})
+	r.Unregister("other", Tags{"overflow": "true"})
+	if err := r.Register("new", Tags{}, metrics.NewCounter()); err != nil {
+		t.Error(err)
+	}
+
+	self := func(name string) int64 {
+		return r.Get("tsdmetrics.registry."+name, DefaultSelfMetricsTags).(metrics.Counter).Count()
+	}
+	if n := self("overflowed"); n != 3 {
+		t.Errorf("Expected 3 registrations overflowed, got %d", n)
+	}
+	if n := self("refused"); n != 2 {
+		t.Errorf("Expected 2 registrations refused, got %d", n)
+	}
+}
+
+func TestCardinalityLimitsSegmented(t *testing.T) {
+	root := NewRootSegmentedTaggedRegistry(Tags{"host": "a"})
+	api := NewSegmentedTaggedRegistry("api", Tags{"service": "api"}, root)
+	api.(*SegmentedTaggedRegistry).SetCardinalityLimits(CardinalityLimits{MaxSeriesPerMetric: 2, Overflow: Tags{"overflow": "true"}})
+
+	for i := 0; i < 4; i++ {
+		c := api.GetOrRegister("requests", Tags{"user": fmt.Sprint(i)}, metrics.NewCounter).(metrics.Counter)
+		c.Inc(1)
+	}
+
+	// Looked up through the segment, whose tags are added back.
+	overflow, ok := api.Get("requests", Tags{"overflow": "true"}).(metrics.Counter)
+	if !ok || overflow.Count() != 2 {
+		t.Errorf("Expected the overflow series to keep the segment tags, got %v", overflow)
+	}
+	var self []Tags
+	root.Each(func(name string, m TaggedMetric) {
+		if name == "api.tsdmetrics.registry.overflowed" {
+			self = append(self, m.GetTags())
+		}
+	})
+	if len(self) != 1 || self[0].TagsID() != (Tags{"host": "a", "service": "api", "tsdmetrics": "self"}).TagsID() {
+		t.Errorf("Expected the counters to carry the segment tags, got %v", self)
+	}
+}
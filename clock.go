@@ -0,0 +1,166 @@
+package tsdmetrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the time to the exporter so that tests can control it.
+type Clock interface {
+	Now() time.Time
+	NewTimer(time.Duration) Timer
+}
+
+// Timer is the subset of time.Timer used by the run loops.
+type Timer interface {
+	C() <-chan time.Time
+	Reset(time.Duration) bool
+	Stop() bool
+}
+
+// RealClock is the Clock backed by the time package.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+func (t *TaggedOpenTSDB) clock() Clock {
+	if t.Clock == nil {
+		return RealClock{}
+	}
+	return t.Clock
+}
+
+// FakeClock is a Clock which only moves when told to. Its timers fire
+// during the Advance or Set call which moves the time past their deadline.
+type FakeClock struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock set at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.schedule(t, d)
+	return t
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// Set moves the clock to now, which must not be before the current time.
+func (c *FakeClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.set(now)
+}
+
+// BlockUntil waits until n timers are waiting to fire, which is how tests
+// know that a run loop is idle.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+func (c *FakeClock) set(now time.Time) {
+	c.now = now
+
+	sort.Slice(c.timers, func(i, j int) bool { return c.timers[i].deadline.Before(c.timers[j].deadline) })
+	var waiting []*fakeTimer
+	for _, t := range c.timers {
+		if t.deadline.After(now) {
+			waiting = append(waiting, t)
+			continue
+		}
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+	c.timers = waiting
+}
+
+func (c *FakeClock) schedule(t *fakeTimer, d time.Duration) {
+	t.deadline = c.now.Add(d)
+	if d <= 0 {
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		return
+	}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+}
+
+// unschedule removes t from the pending timers and tells if it was there.
+func (c *FakeClock) unschedule(t *fakeTimer) bool {
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	c        chan time.Time
+	deadline time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.clock.unschedule(t)
+	t.clock.schedule(t, d)
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.clock.unschedule(t)
+}
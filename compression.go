@@ -0,0 +1,161 @@
+package tsdmetrics
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects the codec used for the body of Json requests.
+type Compression int
+
+const (
+	NoCompression Compression = iota
+	Gzip
+	Deflate // zlib stream, as expected for the deflate content coding
+	Zstd
+	Snappy // Snappy block format
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Deflate:
+		return "deflate"
+	case Zstd:
+		return "zstd"
+	case Snappy:
+		return "snappy"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+func (c Compression) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText parses a codec from its name as returned by String.
+func (c *Compression) UnmarshalText(b []byte) error {
+	for codec := NoCompression; codec <= Snappy; codec++ {
+		if string(b) == codec.String() {
+			*c = codec
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown compression: %s", b)
+}
+
+// ContentEncoding returns the value of the Content-Encoding header for c.
+func (c Compression) ContentEncoding() string {
+	if c == NoCompression {
+		return ""
+	}
+	return c.String()
+}
+
+// compressor is implemented by the streaming writers of every codec.
+type compressor interface {
+	io.WriteCloser
+	Reset(io.Writer)
+
+	// Flush pushes the data written so far to the underlying writer.
+	Flush() error
+}
+
+// Upper bound of the compressed size of n bytes, covering the worst case
+// expansion of all codecs and their framing.
+func maxCompressedLen(n int) int {
+	return n + n/6 + 64
+}
+
+type compressorKey struct {
+	codec Compression
+	level int
+}
+
+var compressorPools sync.Map // compressorKey -> *sync.Pool
+
+// getCompressor returns a compressor for codec at level writing to w, reusing
+// a pooled one when available. A level of 0 selects the codec's default.
+func getCompressor(codec Compression, level int, w io.Writer) (compressor, error) {
+	key := compressorKey{codec, level}
+	if p, ok := compressorPools.Load(key); ok {
+		if cw, ok := p.(*sync.Pool).Get().(compressor); ok {
+			cw.Reset(w)
+			return cw, nil
+		}
+	}
+
+	switch codec {
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case Deflate:
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+		return zlib.NewWriterLevel(w, level)
+	case Zstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case Snappy:
+		if level != 0 {
+			return nil, fmt.Errorf("snappy does not support compression levels: %d", level)
+		}
+		return &snappyWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("Unsupported compression: %s", codec)
+}
+
+// putCompressor gives cw back to the pool once it has been closed.
+func putCompressor(codec Compression, level int, cw compressor) {
+	cw.Reset(nil)
+	p, _ := compressorPools.LoadOrStore(compressorKey{codec, level}, &sync.Pool{})
+	p.(*sync.Pool).Put(cw)
+}
+
+// snappyWriter buffers its input and writes it as a single Snappy block
+// when closed. Flush is a no-op as the block format cannot be streamed.
+type snappyWriter struct {
+	w   io.Writer
+	raw []byte
+	dst []byte
+}
+
+func (s *snappyWriter) Write(b []byte) (int, error) {
+	s.raw = append(s.raw, b...)
+	return len(b), nil
+}
+
+func (s *snappyWriter) Flush() error {
+	return nil
+}
+
+func (s *snappyWriter) Close() error {
+	s.dst = snappy.Encode(s.dst[:cap(s.dst)], s.raw)
+	_, err := s.w.Write(s.dst)
+	return err
+}
+
+func (s *snappyWriter) Reset(w io.Writer) {
+	s.w = w
+	s.raw = s.raw[:0]
+}
+
+// Buffered returns the amount of data not yet written to the underlying writer.
+func (s *snappyWriter) Buffered() int {
+	return len(s.raw)
+}
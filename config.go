@@ -0,0 +1,558 @@
+package tsdmetrics
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config describes a registry tree and the exporters of its metrics. It is
+// read from YAML or Json with ParseConfig, and from environment variables
+// with ApplyEnv.
+type Config struct {
+	Tags         Tags               `yaml:"tags" json:"tags"`                   // Default tags of every metric
+	DiscoverTags *DefaultTagsConfig `yaml:"discover_tags" json:"discover_tags"` // Default tags found with DefaultTags, overridden by Tags
+	Runtime      bool               `yaml:"runtime" json:"runtime"`             // Collect the Go runtime statistics before each flush
+	Segments     []SegmentConfig    `yaml:"segments" json:"segments"`
+	Exporters    []ExporterConfig   `yaml:"exporters" json:"exporters"`
+}
+
+// SegmentConfig describes a SegmentedTaggedRegistry under the root one.
+type SegmentConfig struct {
+	Prefix         string   `yaml:"prefix" json:"prefix"`
+	Tags           Tags     `yaml:"tags" json:"tags"`
+	ExportInterval Duration `yaml:"export_interval" json:"export_interval"`
+}
+
+// ExporterConfig describes a TaggedOpenTSDB exporting the whole tree.
+type ExporterConfig struct {
+	Addr             string         `yaml:"addr" json:"addr"`                   // host:port for Tcollector, URL for Json
+	File             string         `yaml:"file" json:"file"`                   // Path of a RotatingFile written to instead of Addr
+	FileMaxSize      int64          `yaml:"file_max_size" json:"file_max_size"` // Size the file is rotated at, 0 for never
+	Format           OpenTSDBFormat `yaml:"format" json:"format"`
+	FlushInterval    Duration       `yaml:"flush_interval" json:"flush_interval"`
+	AlignFlushes     bool           `yaml:"align_flushes" json:"align_flushes"`
+	FlushSplay       Duration       `yaml:"flush_splay" json:"flush_splay"`
+	DurationUnit     Duration       `yaml:"duration_unit" json:"duration_unit"`
+	Compression      Compression    `yaml:"compression" json:"compression"`
+	CompressionLevel int            `yaml:"compression_level" json:"compression_level"`
+	BulkSize         int            `yaml:"bulk_size" json:"bulk_size"`
+	MaxBulkBytes     int            `yaml:"max_bulk_bytes" json:"max_bulk_bytes"`
+	ShutdownTimeout  Duration       `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	AnnotationAddr   string         `yaml:"annotation_addr" json:"annotation_addr"` // URL of /api/annotation, derived from Addr when empty
+	SelfMetrics      bool           `yaml:"self_metrics" json:"self_metrics"`
+	Tags             Tags           `yaml:"tags" json:"tags"` // Added at export time to the series without them
+	Filter           *SeriesFilter  `yaml:"filter" json:"filter"`
+	Relabel          []RelabelRule  `yaml:"relabel" json:"relabel"`
+}
+
+// Duration is a time.Duration written like "10s" in configurations.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ParseConfig reads a Config from YAML, or Json which YAML includes. Unknown
+// fields are errors.
+func ParseConfig(b []byte) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %s", err)
+	}
+	return &c, nil
+}
+
+// LoadConfig reads a Config from a YAML or Json file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(b)
+}
+
+// ApplyEnv overrides the fields of c with the environment variables named
+// after their path, prefix first: for the prefix "METRICS",
+// METRICS_EXPORTERS_0_FLUSH_INTERVAL=30s sets the flush interval of the first
+// exporter. Tags are written "k1=v1,k2=v2" and lists of strings are comma
+// separated.
+func (c *Config) ApplyEnv(prefix string) error {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i > 0 && strings.HasPrefix(kv[:i], prefix+"_") {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return applyEnv(reflect.ValueOf(c).Elem(), prefix, env)
+}
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	tagsType            = reflect.TypeOf(Tags{})
+)
+
+func hasEnvPrefix(env map[string]string, name string) bool {
+	for k := range env {
+		if k == name || strings.HasPrefix(k, name+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+func applyEnv(v reflect.Value, name string, env map[string]string) error {
+	if s, ok := env[name]; ok && (v.Kind() != reflect.Struct || reflect.PtrTo(v.Type()).Implements(textUnmarshalerType)) {
+		if err := setFromEnv(v, s); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !hasEnvPrefix(env, name) {
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return applyEnv(v.Elem(), name, env)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if f.PkgPath != "" || tag == "" || tag == "-" {
+				continue
+			}
+			if err := applyEnv(v.Field(i), name+"_"+strings.ToUpper(tag), env); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; hasEnvPrefix(env, name+"_"+strconv.Itoa(i)) || i < v.Len(); i++ {
+			if i >= v.Len() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			if err := applyEnv(v.Index(i), name+"_"+strconv.Itoa(i), env); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setFromEnv(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Map:
+		if v.Type() != tagsType {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		tags, err := TagsFromString(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(tags))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		v.Set(reflect.ValueOf(strings.Split(s, ",")).Convert(v.Type()))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Validate checks c and reports all its errors with their field paths.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, ConfigError{path, fmt.Sprintf(format, args...)})
+	}
+
+	validateTags(c.Tags, "tags", add)
+	prefixes := make(map[string]bool)
+	for i, s := range c.Segments {
+		path := fmt.Sprintf("segments[%d]", i)
+		if s.Prefix == "" {
+			add(path+".prefix", "must be set")
+		} else if prefixes[s.Prefix] {
+			add(path+".prefix", "duplicate segment %s", s.Prefix)
+		}
+		prefixes[s.Prefix] = true
+		validateTags(s.Tags, path+".tags", add)
+		if s.ExportInterval < 0 {
+			add(path+".export_interval", "must not be negative")
+		}
+	}
+	for i := range c.Exporters {
+		c.Exporters[i].validate(fmt.Sprintf("exporters[%d]", i), add)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateTags(tags Tags, path string, add func(string, string, ...interface{})) {
+	for k, v := range tags {
+		if !validOpenTSDB(k) || !validOpenTSDB(v) {
+			add(path+"."+k, "invalid tag %s=%s", k, v)
+		}
+	}
+}
+
+func (e *ExporterConfig) validate(path string, add func(string, string, ...interface{})) {
+	switch {
+	case e.Addr == "" && e.File == "":
+		add(path+".addr", "addr or file must be set")
+	case e.Addr != "" && e.File != "":
+		add(path+".file", "addr and file are exclusive")
+	case e.Addr != "" && e.Format == Json:
+		if u, err := url.Parse(e.Addr); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			add(path+".addr", "must be an http(s) URL for the json format: %s", e.Addr)
+		}
+	case e.Addr != "" && e.Format == Tcollector:
+		if _, _, err := net.SplitHostPort(e.Addr); err != nil {
+			add(path+".addr", "must be host:port for the tcollector format: %s", err)
+		}
+	case e.Addr != "":
+		add(path+".format", "%s is only supported with file", e.Format)
+	}
+	if e.AnnotationAddr != "" {
+		if u, err := url.Parse(e.AnnotationAddr); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			add(path+".annotation_addr", "must be an http(s) URL: %s", e.AnnotationAddr)
+		}
+	}
+	if _, ok := formatNames[e.Format]; !ok {
+		add(path+".format", "unknown format %s", e.Format)
+	}
+
+	if e.FlushInterval <= 0 {
+		add(path+".flush_interval", "must be positive")
+	}
+	for field, d := range map[string]Duration{"flush_splay": e.FlushSplay, "duration_unit": e.DurationUnit, "shutdown_timeout": e.ShutdownTimeout} {
+		if d < 0 {
+			add(path+"."+field, "must not be negative")
+		}
+	}
+	if e.Compression != NoCompression && (e.Format != Json || e.Addr == "") {
+		add(path+".compression", "only applies to the json format sent to addr")
+	}
+	if e.CompressionLevel != 0 && e.Compression == NoCompression {
+		add(path+".compression_level", "needs a compression")
+	}
+	for field, n := range map[string]int{"bulk_size": e.BulkSize, "max_bulk_bytes": e.MaxBulkBytes} {
+		if n < 0 {
+			add(path+"."+field, "must not be negative")
+		}
+	}
+	if e.FileMaxSize < 0 {
+		add(path+".file_max_size", "must not be negative")
+	}
+	validateTags(e.Tags, path+".tags", add)
+
+	if e.Filter != nil {
+		if err := e.Filter.Compile(); err != nil {
+			add(path+".filter", "%s", err)
+		}
+	}
+	for i := range e.Relabel {
+		rule := e.Relabel[i]
+		if err := rule.compile(); err != nil {
+			add(fmt.Sprintf("%s.relabel[%d]", path, i), "%s", err)
+		}
+	}
+}
+
+// Metrics is a registry tree and its running exporters, as described by a
+// Config.
+//
+// The exporters share the registry tree, metrics queued with Add() included:
+// each of those is only reported by the exporter which flushes first.
+type Metrics struct {
+	Registry  TaggedRegistry            // Root of the tree, giving the default tags
+	Segments  map[string]TaggedRegistry // Segments by prefix
+	Exporters []*TaggedOpenTSDB
+
+	ctx      context.Context
+	root     TaggedRegistry
+	pipeline Pipeline
+	logger   log.FieldLogger
+	mutex    sync.Mutex // Serializes Update and Close
+	wg       sync.WaitGroup
+}
+
+// NewMetrics validates c, builds its registry tree and runs its exporters
+// until ctx is cancelled or Close is called.
+func NewMetrics(ctx context.Context, c *Config, logger log.FieldLogger) (*Metrics, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+
+	tags := Tags{}
+	if c.DiscoverTags != nil {
+		discovered, err := DefaultTags(*c.DiscoverTags)
+		if err != nil {
+			return nil, err
+		}
+		tags = discovered
+	}
+	for k, v := range c.Tags {
+		tags[k] = v
+	}
+
+	m := &Metrics{
+		ctx:    ctx,
+		root:   NewTaggedRegistry(),
+		logger: logger,
+	}
+	m.Registry = NewSegmentedTaggedRegistry("", tags, m.root)
+	m.Segments = make(map[string]TaggedRegistry, len(c.Segments))
+	for _, s := range c.Segments {
+		segment := NewSegmentedTaggedRegistry(s.Prefix, s.Tags, m.Registry)
+		segment.(*SegmentedTaggedRegistry).SetExportInterval(time.Duration(s.ExportInterval))
+		m.Segments[s.Prefix] = segment
+	}
+
+	if c.Runtime {
+		RegisterTaggedRuntimeMemStats(m.Registry)
+		m.pipeline.Collectors = append(m.pipeline.Collectors, CollectorFunc(func(context.Context, TaggedRegistry) error {
+			CaptureTaggedRuntimeMemStatsOnce(m.Registry)
+			return nil
+		}))
+	}
+
+	for _, ec := range c.Exporters {
+		e, err := m.newExporter(ec)
+		if err != nil {
+			m.closeFiles(m.Exporters)
+			return nil, err
+		}
+		m.Exporters = append(m.Exporters, e)
+	}
+	for _, e := range m.Exporters {
+		m.run(e)
+	}
+	return m, nil
+}
+
+func (m *Metrics) newExporter(c ExporterConfig) (*TaggedOpenTSDB, error) {
+	e := &TaggedOpenTSDB{Registry: m.root, SelfMetricsRegistry: m.Registry, Pipeline: m.pipeline, Logger: m.logger}
+	if err := e.apply(c); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (m *Metrics) run(e *TaggedOpenTSDB) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		e.Run(m.ctx)
+	}()
+}
+
+// Update applies the exporters of c to the running ones, which are updated
+// in place, started or stopped so that the nth exporter follows the nth
+// ExporterConfig. The registry tree is only built by NewMetrics, changes of
+// Tags, DiscoverTags, Runtime and Segments are ignored.
+func (m *Metrics) Update(c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, ec := range c.Exporters {
+		if i < len(m.Exporters) {
+			if err := m.Exporters[i].Update(ec); err != nil {
+				return err
+			}
+			continue
+		}
+		e, err := m.newExporter(ec)
+		if err != nil {
+			return err
+		}
+		m.Exporters = append(m.Exporters, e)
+		m.run(e)
+	}
+
+	if removed := m.Exporters[len(c.Exporters):]; len(removed) > 0 {
+		m.Exporters = m.Exporters[:len(c.Exporters)]
+		for _, e := range removed {
+			if err := e.Close(); err != nil {
+				m.logger.Errorf("Last flush of a removed exporter failed: %s", err)
+			}
+		}
+		m.closeFiles(removed)
+	}
+	return nil
+}
+
+// Annotate queues a on every exporter, see TaggedOpenTSDB.Annotate.
+func (m *Metrics) Annotate(a Annotation) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, e := range m.Exporters {
+		if err := e.Annotate(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the exporters after their last flush and returns the first
+// error of those flushes.
+func (m *Metrics) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var err error
+	for _, e := range m.Exporters {
+		if cerr := e.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	m.wg.Wait()
+	m.closeFiles(m.Exporters)
+	return err
+}
+
+// closeFiles closes the files written by exporters which are stopped.
+func (m *Metrics) closeFiles(exporters []*TaggedOpenTSDB) {
+	for _, e := range exporters {
+		if f, ok := e.Writer.(*RotatingFile); ok {
+			f.Close()
+		}
+	}
+}
+
+// Update applies c to the exporter, running or not. The new settings are
+// swapped in between two flushes, along with the flush schedule, and the
+// state kept across flushes, such as the suppressed values and the rate
+// limit budget, is preserved. Metrics queued with Add() are not affected.
+//
+// Every field covered by ExporterConfig is set from c, zero values included,
+// which also applies to exporters built by hand: a Writer is only kept when c
+// has no File, Relabeling is replaced by c.Relabel and Compress is cleared so
+// that c.Compression alone picks the compression.
+func (t *TaggedOpenTSDB) Update(c ExporterConfig) error {
+	var errs ConfigErrors
+	c.validate("exporter", func(path, format string, args ...interface{}) {
+		errs = append(errs, ConfigError{path, fmt.Sprintf(format, args...)})
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+
+	t.flushMutex.Lock()
+	old := t.Writer
+	err := t.apply(c)
+	replaced := t.Writer != old
+	// The intervals seen so far may include the previous FlushInterval.
+	t.intervals = t.registryIntervals()
+	t.flushMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if f, ok := old.(*RotatingFile); ok && replaced {
+		f.Close()
+	}
+	select {
+	case t.getLifecycle().updates <- struct{}{}:
+	default:
+		// An update is already pending, it will see these settings too.
+	}
+	return nil
+}
+
+// apply sets the fields of the exporter from c. The file written to is only
+// reopened when its path changes, and a Writer which was not opened from File
+// is kept.
+func (t *TaggedOpenTSDB) apply(c ExporterConfig) error {
+	writer := t.Writer
+	if f, ok := writer.(*RotatingFile); c.File != "" && (!ok || f.Path != c.File) {
+		nf, err := NewRotatingFile(c.File, c.FileMaxSize, 0)
+		if err != nil {
+			return err
+		}
+		writer = nf
+	} else if ok {
+		f.MaxSize = c.FileMaxSize
+	}
+	if _, ok := writer.(*RotatingFile); ok && c.File == "" {
+		writer = nil
+	}
+
+	if c.Addr != t.Addr {
+		t.netAddr = nil
+	}
+	t.Addr = c.Addr
+	t.Writer = writer
+	t.FlushInterval = time.Duration(c.FlushInterval)
+	t.AlignFlushes = c.AlignFlushes
+	t.FlushSplay = time.Duration(c.FlushSplay)
+	t.DurationUnit = time.Duration(c.DurationUnit)
+	t.Format = c.Format
+	t.Compress = false
+	t.Compression = c.Compression
+	t.CompressionLevel = c.CompressionLevel
+	t.BulkSize = c.BulkSize
+	t.MaxBulkBytes = c.MaxBulkBytes
+	t.ShutdownTimeout = time.Duration(c.ShutdownTimeout)
+	t.AnnotationAddr = c.AnnotationAddr
+	t.SelfMetrics = c.SelfMetrics
+	t.Filter = c.Filter
+	t.Relabeling = nil
+	if len(c.Relabel) > 0 {
+		t.Relabeling = &Relabeling{Rules: c.Relabel}
+	}
+	t.Tags = c.Tags
+	return nil
+}
@@ -0,0 +1,361 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const testConfig = `
+tags:
+  dc: par1
+segments:
+  - prefix: app
+    tags: {team: core}
+    export_interval: 1m
+exporters:
+  - addr: http://localhost:4242/api/put
+    format: json
+    flush_interval: 10s
+    compression: gzip
+    filter:
+      deny:
+        - name: "*.std-dev"
+        - tags: [{key: env, type: regex, value: "dev|test"}]
+    relabel:
+      - source_tags: [__name__]
+        regex: 'old\.(.*)'
+        target: __name__
+        replacement: 'new.$1'
+`
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	e := c.Exporters[0]
+	if e.Format != Json || e.Compression != Gzip || time.Duration(e.FlushInterval) != 10*time.Second ||
+		e.Filter.Deny[1].Tags[0].Type != TagRegex || len(e.Relabel) != 1 {
+		t.Errorf("Unexpected exporter: %+v", e)
+	}
+
+	json := `{"tags": {"dc": "par1"}, "exporters": [{"addr": "tsd:4242", "format": "tcollector", "flush_interval": "5s"}]}`
+	if c, err = ParseConfig([]byte(json)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseConfig([]byte("exporters: [{adr: tsd:4242}]")); err == nil {
+		t.Error("Expected unknown fields to be refused")
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	c, err := ParseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"TSDTEST_TAGS":                            "dc=ams1,rack=b2",
+		"TSDTEST_EXPORTERS_0_FLUSH_INTERVAL":      "30s",
+		"TSDTEST_EXPORTERS_1_ADDR":                "tsd:4242",
+		"TSDTEST_EXPORTERS_1_FLUSH_INTERVAL":      "1m",
+		"TSDTEST_EXPORTERS_1_FILTER_ALLOW_0_NAME": "app.*",
+		"TSDTEST_DISCOVER_TAGS_PID":               "true",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	if err := c.ApplyEnv("TSDTEST"); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Tags["dc"] != "ams1" || c.Tags["rack"] != "b2" {
+		t.Errorf("Unexpected tags: %v", c.Tags)
+	}
+	if time.Duration(c.Exporters[0].FlushInterval) != 30*time.Second || c.Exporters[0].Format != Json {
+		t.Errorf("Unexpected first exporter: %+v", c.Exporters[0])
+	}
+	if len(c.Exporters) != 2 || c.Exporters[1].Addr != "tsd:4242" || c.Exporters[1].Filter.Allow[0].Name != "app.*" {
+		t.Errorf("Unexpected exporters: %+v", c.Exporters)
+	}
+	if c.DiscoverTags == nil || !c.DiscoverTags.PID {
+		t.Errorf("Unexpected tags discovery: %+v", c.DiscoverTags)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c, err := ParseConfig([]byte(`
+tags: {"bad tag": x}
+segments: [{tags: {a: b}}]
+exporters:
+  - addr: tsd:4242
+    format: json
+    compression_level: 3
+  - file: /tmp/metrics
+    flush_interval: 1s
+    relabel: [{action: replace}]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got %v", err)
+	}
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	got := strings.Join(paths, " ")
+	for _, expected := range []string{
+		"tags.bad tag",
+		"segments[0].prefix",
+		"exporters[0].addr",
+		"exporters[0].flush_interval",
+		"exporters[0].compression_level",
+		"exporters[1].relabel[0]",
+	} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("Expected an error at %s, got %v", expected, err)
+		}
+	}
+}
+
+func TestNewMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdmetrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.txt")
+
+	c := &Config{
+		Tags:     Tags{"host": "web-1"},
+		Segments: []SegmentConfig{{Prefix: "app", Tags: Tags{"team": "core"}}},
+		Exporters: []ExporterConfig{{
+			File:          path,
+			Format:        Tcollector,
+			FlushInterval: Duration(time.Hour),
+			SelfMetrics:   true,
+		}},
+	}
+	m, err := NewMetrics(context.Background(), c, log.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Segments["app"].Register("requests", Tags{}, metrics.NewCounter())
+	for _, e := range m.Exporters {
+		waitRunning(e)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "put app.requests ") || !strings.Contains(string(b), " host=web-1 team=core \n") {
+		t.Errorf("Unexpected export:\n%s", b)
+	}
+	if !strings.Contains(string(b), " host=web-1 tsdmetrics=self \n") {
+		t.Errorf("Expected the self metrics to carry the default tags:\n%s", b)
+	}
+}
+
+func TestExporterUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdmetrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewTaggedRegistry()
+	r.Register("app.requests", Tags{"host": "a"}, metrics.NewCounter())
+	r.Register("debug.requests", Tags{"host": "a"}, metrics.NewCounter())
+
+	start := time.Date(2017, 9, 15, 14, 4, 50, 0, time.UTC)
+	clock := NewFakeClock(start)
+	results := make(chan FlushResult, 1)
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{
+		Writer:        &buf,
+		Registry:      r,
+		Format:        Tcollector,
+		FlushInterval: 10 * time.Second,
+		Clock:         clock,
+		Logger:        log.New(),
+		OnFlush:       func(res FlushResult) { results <- res },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(10 * time.Second)
+	if res := <-results; res.Points != 2 {
+		t.Errorf("Expected both metrics before the update, got %d points", res.Points)
+	}
+
+	c := metrics.NewCounter()
+	c.Inc(1)
+	r.Add("app.oneshot", Tags{"host": "a"}, c)
+
+	path := filepath.Join(dir, "metrics.txt")
+	err = e.Update(ExporterConfig{
+		File:          path,
+		Format:        Tcollector,
+		FlushInterval: Duration(time.Minute),
+		Tags:          Tags{"env": "prod"},
+		Filter:        &SeriesFilter{Deny: []SeriesMatcher{{Name: "debug.*"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDeadline(clock, start.Add(10*time.Second+time.Minute))
+
+	clock.Advance(time.Minute)
+	res := <-results
+	if res.Points != 2 || !res.Timestamp.Equal(start.Add(10*time.Second+time.Minute)) {
+		t.Errorf("Unexpected flush after the update: %+v", res)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := sortLines(string(b))
+	expected := "put app.oneshot 1505484360 1 env=prod host=a \nput app.requests 1505484360 0 env=prod host=a \n"
+	if lines != expected {
+		t.Errorf("Unexpected export after the update:\n%s", lines)
+	}
+
+	if err := e.Update(ExporterConfig{Format: Json}); err == nil {
+		t.Error("Expected an invalid configuration to be refused")
+	}
+
+	cancel()
+	<-results
+	<-done
+	e.Writer.(*RotatingFile).Close()
+}
+
+// waitDeadline waits until the only timer of clock fires at deadline.
+func waitDeadline(clock *FakeClock, deadline time.Time) {
+	for {
+		clock.mutex.Lock()
+		ok := len(clock.timers) == 1 && clock.timers[0].deadline.Equal(deadline)
+		clock.mutex.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestExporterUpdateKeepsIntervals(t *testing.T) {
+	r := NewTaggedRegistry()
+	r.Register("default", Tags{"host": "a"}, metrics.NewCounter())
+	r.Register("slow", Tags{"host": "a"}, metrics.NewCounter())
+	if err := setMetricExportInterval(r, "slow", Tags{"host": "a"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "tsdmetrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := ExporterConfig{File: filepath.Join(dir, "metrics.txt"), Format: Tcollector, FlushInterval: Duration(10 * time.Second)}
+
+	start := time.Date(2017, 9, 15, 14, 4, 50, 0, time.UTC)
+	clock := NewFakeClock(start)
+	results := make(chan FlushResult, 1)
+	e := &TaggedOpenTSDB{Registry: r, Clock: clock, Logger: log.New(), OnFlush: func(res FlushResult) { results <- res }}
+	if err := e.apply(c); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Writer.(*RotatingFile).Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(10 * time.Second)
+	if res := <-results; res.Points != 2 {
+		t.Errorf("Expected both metrics in the first flush, got %d points", res.Points)
+	}
+
+	c.FlushInterval = Duration(20 * time.Second)
+	if err := e.Update(c); err != nil {
+		t.Fatal(err)
+	}
+	waitDeadline(clock, start.Add(30*time.Second))
+	clock.Advance(20 * time.Second)
+	if res := <-results; res.Points != 1 {
+		t.Errorf("Expected only the metric at FlushInterval after the update, got %d points", res.Points)
+	}
+
+	cancel()
+	<-results
+	<-done
+}
+
+func TestExporterUpdateSelfMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdmetrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := ExporterConfig{File: filepath.Join(dir, "metrics.txt"), Format: Tcollector, FlushInterval: Duration(time.Minute)}
+
+	r := NewTaggedRegistry()
+	e := &TaggedOpenTSDB{Registry: r, Compress: true, Logger: log.New()}
+	if err := e.apply(c); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Writer.(*RotatingFile).Close()
+	if e.compression() != NoCompression {
+		t.Errorf("Expected Compress to be cleared, got %v", e.compression())
+	}
+
+	registered := func() bool {
+		return r.Get("tsdmetrics.exporter.points", DefaultSelfMetricsTags) != nil
+	}
+	for _, on := range []bool{true, false, true} {
+		c.SelfMetrics = on
+		if err := e.Update(c); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+		if registered() != on {
+			t.Errorf("Expected self metrics registered: %t", on)
+		}
+	}
+}
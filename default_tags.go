@@ -0,0 +1,107 @@
+package tsdmetrics
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultTagsConfig selects what DefaultTags discovers on top of the host tag.
+type DefaultTagsConfig struct {
+	FQDN        bool   `yaml:"fqdn" json:"fqdn"`                 // Use the fully qualified domain name as host, when it resolves
+	Process     bool   `yaml:"process" json:"process"`           // Add the executable name as process
+	PID         bool   `yaml:"pid" json:"pid"`                   // Add the process ID as pid
+	EnvPrefix   string `yaml:"env_prefix" json:"env_prefix"`     // Add the environment variables with this prefix, keyed by the rest of their lowercased name
+	ContainerID bool   `yaml:"container_id" json:"container_id"` // Add the container ID found in /proc/self/cgroup as container_id
+	Overrides   Tags   `yaml:"overrides" json:"overrides"`       // Replace the discovered tags, an empty value removing the tag
+}
+
+const cgroupPath = "/proc/self/cgroup"
+
+// DefaultTags builds tags describing the host and process, for example for
+// NewRootSegmentedTaggedRegistry. Every value goes through CleanOpenTSDB.
+func DefaultTags(c DefaultTagsConfig) (Tags, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	if c.FQDN {
+		host = fqdn(host)
+	}
+	tags := Tags{"host": host}
+
+	if c.Process {
+		tags["process"] = filepath.Base(os.Args[0])
+	}
+	if c.PID {
+		tags["pid"] = strconv.Itoa(os.Getpid())
+	}
+	if c.EnvPrefix != "" {
+		for _, kv := range os.Environ() {
+			i := strings.IndexByte(kv, '=')
+			if i < 0 || !strings.HasPrefix(kv[:i], c.EnvPrefix) {
+				continue
+			}
+			if k := strings.ToLower(kv[len(c.EnvPrefix):i]); k != "" {
+				tags[CleanOpenTSDB(k)] = kv[i+1:]
+			}
+		}
+	}
+	if c.ContainerID {
+		if f, err := os.Open(cgroupPath); err == nil {
+			tags["container_id"] = containerID(f)
+			f.Close()
+		}
+	}
+
+	for k, v := range c.Overrides {
+		tags[k] = v
+	}
+	for k, v := range tags {
+		if v == "" {
+			delete(tags, k)
+		} else {
+			tags[k] = CleanOpenTSDB(v)
+		}
+	}
+	return tags, nil
+}
+
+// fqdn returns the name the addresses of host resolve back to, host itself
+// when they do not.
+func fqdn(host string) string {
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return host
+	}
+	for _, addr := range addrs {
+		if names, err := net.LookupAddr(addr); err == nil && len(names) > 0 {
+			return strings.TrimSuffix(names[0], ".")
+		}
+	}
+	return host
+}
+
+var containerIDRegexp = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// containerID returns the container ID found in the paths of a cgroup file,
+// as set by Docker, containerd and CRI-O, or "" outside of a container.
+func containerID(r io.Reader) string {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(s.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if id := containerIDRegexp.FindString(parts[2]); id != "" {
+			return id
+		}
+	}
+	return ""
+}
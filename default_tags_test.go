@@ -0,0 +1,40 @@
+package tsdmetrics
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDefaultTags(t *testing.T) {
+	os.Setenv("TSDTEST_TEAM", "core metrics")
+	defer os.Unsetenv("TSDTEST_TEAM")
+
+	tags, err := DefaultTags(DefaultTagsConfig{
+		PID:       true,
+		EnvPrefix: "TSDTEST_",
+		Overrides: Tags{"host": "web-1", "dc": "par 1", "pid": ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Tags{"host": "web-1", "dc": "par_1", "team": "core_metrics"}
+	if tags.TagsID() != expected.TagsID() {
+		t.Errorf("Expected %v, got %v", expected, tags)
+	}
+}
+
+func TestContainerID(t *testing.T) {
+	id := strings.Repeat("0123456789abcdef", 4)
+	for cgroup, expected := range map[string]string{
+		"12:pids:/docker/" + id + "\n":                                        id,
+		"0::/system.slice/cri-containerd-" + id + ".scope\n":                  id,
+		"11:memory:/kubepods/burstable/pod1234/" + id + "\n1:cpu:/kubepods\n": id,
+		"0::/user.slice/user-1000.slice/session-2.scope\n":                    "",
+	} {
+		if got := containerID(strings.NewReader(cgroup)); got != expected {
+			t.Errorf("%q: expected %q, got %q", cgroup, expected, got)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package tsdmetrics
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // DuplicateMetric is the error returned by Registry.Register when a metric
 // already exists.  If you mean to Register that metric you must first
@@ -13,3 +16,46 @@ type DuplicateTaggedMetric struct {
 func (err DuplicateTaggedMetric) Error() string {
 	return fmt.Sprintf("duplicate metric: %s %s", err.name, err.tags.String())
 }
+
+// UnknownTaggedMetric is the error returned when operating on a metric which
+// is not registered.
+type UnknownTaggedMetric struct {
+	name string
+	tags Tags
+}
+
+func (err UnknownTaggedMetric) Error() string {
+	return fmt.Sprintf("unknown metric: %s %s", err.name, err.tags.String())
+}
+
+// CardinalityLimitExceeded is the error returned when registering a series
+// over the cardinality limits of a registry.
+type CardinalityLimitExceeded struct {
+	name string
+	tags Tags
+}
+
+func (err CardinalityLimitExceeded) Error() string {
+	return fmt.Sprintf("cardinality limit exceeded: %s %s", err.name, err.tags.String())
+}
+
+// ConfigError is an error of the field of a Config at Path.
+type ConfigError struct {
+	Path string
+	Msg  string
+}
+
+func (err ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Path, err.Msg)
+}
+
+// ConfigErrors lists all the errors of a Config.
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,91 @@
+package tsdmetrics
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type dueIntervalsKey struct{}
+
+// withDueIntervals restricts the flushes run with ctx to the metrics exported
+// every interval of due.
+func withDueIntervals(ctx context.Context, due map[time.Duration]bool) context.Context {
+	return context.WithValue(ctx, dueIntervalsKey{}, due)
+}
+
+func dueIntervals(ctx context.Context) map[time.Duration]bool {
+	due, _ := ctx.Value(dueIntervalsKey{}).(map[time.Duration]bool)
+	return due
+}
+
+// exportInterval returns the interval tm is exported at.
+func (t *TaggedOpenTSDB) exportInterval(tm TaggedMetric) time.Duration {
+	if m, ok := tm.(interface {
+		GetInterval() time.Duration
+	}); ok {
+		if d := m.GetInterval(); d > 0 {
+			return d
+		}
+	}
+	return t.FlushInterval
+}
+
+// isDue tells if tm must be exported by the current flush, and records its
+// interval so that the run loop schedules it. Metrics added with Add() are
+// always due as they are only reported once, and so are the metrics of an
+// interval seen for the first time.
+func (t *TaggedOpenTSDB) isDue(tm TaggedMetric) bool {
+	d := t.exportInterval(tm)
+	if t.intervals == nil {
+		t.intervals = make(map[time.Duration]bool)
+	}
+	known := t.intervals[d]
+	t.intervals[d] = true
+
+	// New intervals are not scheduled yet.
+	if t.due == nil || t.due[d] || !known {
+		return true
+	}
+	m, ok := tm.(*DefaultTaggedMetric)
+	return ok && m.oneShot
+}
+
+// setMetricExportInterval sets the export interval of a metric of r, when r
+// supports it.
+func setMetricExportInterval(r TaggedRegistry, name string, tags Tags, d time.Duration) error {
+	if s, ok := r.(interface {
+		SetMetricExportInterval(string, Tags, time.Duration) error
+	}); ok {
+		return s.SetMetricExportInterval(name, tags, d)
+	}
+	return fmt.Errorf("Registry does not support export intervals: %T", r)
+}
+
+// registryIntervals returns the export intervals of the metrics of the
+// registry, for exporters whose FlushInterval changed. It is nil when the
+// registry cannot tell, the next flush then finds them again.
+func (t *TaggedOpenTSDB) registryIntervals() map[time.Duration]bool {
+	r, ok := t.Registry.(interface {
+		ExportIntervals() []time.Duration
+	})
+	if !ok {
+		return nil
+	}
+	intervals := map[time.Duration]bool{t.FlushInterval: true}
+	for _, d := range r.ExportIntervals() {
+		intervals[d] = true
+	}
+	return intervals
+}
+
+// exportIntervals returns the export intervals seen in the registry so far.
+func (t *TaggedOpenTSDB) exportIntervals() []time.Duration {
+	t.flushMutex.Lock()
+	defer t.flushMutex.Unlock()
+	intervals := make([]time.Duration, 0, len(t.intervals))
+	for d := range t.intervals {
+		intervals = append(intervals, d)
+	}
+	return intervals
+}
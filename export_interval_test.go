@@ -0,0 +1,126 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestExportIntervals(t *testing.T) {
+	root := NewRootSegmentedTaggedRegistry(Tags{"host": "a"})
+	fast := NewSegmentedTaggedRegistry("fast", Tags{}, root)
+	fast.(*SegmentedTaggedRegistry).SetExportInterval(time.Second)
+
+	root.Register("slow", Tags{}, metrics.NewCounter())
+	fast.Register("counter", Tags{}, metrics.NewCounter())
+
+	clock := NewFakeClock(time.Date(2017, 9, 15, 14, 4, 50, 0, time.UTC))
+	results := make(chan FlushResult, 1)
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{
+		Writer:        &buf,
+		Registry:      root,
+		Format:        JsonLines,
+		FlushInterval: 10 * time.Second,
+		AlignFlushes:  true,
+		Clock:         clock,
+		Logger:        log.New(),
+		OnFlush:       func(res FlushResult) { results <- res },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+
+	// The first flush exports everything and discovers the 1s interval.
+	clock.BlockUntil(1)
+	clock.Advance(10 * time.Second)
+	if res := <-results; res.Points != 2 {
+		t.Errorf("Expected both metrics in the first flush, got %d points", res.Points)
+	}
+
+	for i := 1; i <= 9; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+		res := <-results
+		if res.Points != 1 {
+			t.Errorf("Expected only the fast metric after %ds, got %d points", i, res.Points)
+		}
+		if !res.Timestamp.Equal(time.Date(2017, 9, 15, 14, 5, i, 0, time.UTC)) {
+			t.Errorf("Unexpected timestamp %s", res.Timestamp)
+		}
+	}
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if res := <-results; res.Points != 2 {
+		t.Errorf("Expected both metrics on the 10s boundary, got %d points", res.Points)
+	}
+
+	cancel()
+	<-results
+	<-done
+}
+
+func TestSetExportIntervalDuringExport(t *testing.T) {
+	r := NewTaggedRegistry()
+	for i := 0; i < 100; i++ {
+		r.Register("requests", Tags{"customer": strconv.Itoa(i)}, metrics.NewCounter())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			tags := Tags{"customer": strconv.Itoa(i)}
+			if err := setMetricExportInterval(r, "requests", tags, time.Duration(i+1)*time.Second); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	e := &TaggedOpenTSDB{Writer: ioutil.Discard, Registry: r, Format: JsonLines, FlushInterval: time.Second, Logger: log.New()}
+	for i := 0; i < 10; i++ {
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestSetSegmentExportIntervalDuringRegistration(t *testing.T) {
+	root := NewRootSegmentedTaggedRegistry(Tags{"host": "a"})
+	fast := NewSegmentedTaggedRegistry("fast", Tags{}, root).(*SegmentedTaggedRegistry)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			fast.SetExportInterval(time.Duration(i%2+1) * time.Second)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		fast.GetOrRegister("requests", Tags{"customer": strconv.Itoa(i)}, metrics.NewCounter)
+	}
+	<-done
+
+	fast.SetExportInterval(time.Minute)
+	fast.Register("late", Tags{}, metrics.NewCounter())
+	intervals := root.(*SegmentedTaggedRegistry).ExportIntervals()
+	found := false
+	for _, d := range intervals {
+		found = found || d == time.Minute
+	}
+	if !found {
+		t.Errorf("Expected the segment interval on the registered metric, got %v", intervals)
+	}
+}
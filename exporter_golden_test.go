@@ -0,0 +1,124 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const goldenTcollector = `put latency.count 1505484300 100 host=a 
+put latency.min 1505484300 1 host=a 
+put latency.max 1505484300 100 host=a 
+put latency.mean 1505484300 50.50 host=a 
+put latency.std-dev 1505484300 28.87 host=a 
+put latency.p50 1505484300 50.50 host=a 
+put latency.p75 1505484300 75.75 host=a 
+put latency.p90 1505484300 90.90 host=a 
+put latency.p95 1505484300 95.95 host=a 
+put latency.p99 1505484300 99.99 host=a 
+`
+
+const goldenJSON = `[{"metric":"latency.count","value":100,"timestamp":1505484300,"tags":{"host":"a"}}
+,{"metric":"latency.min","value":1,"timestamp":1505484300,"tags":{"host":"a"}}
+,{"metric":"latency.max","value":100,"timestamp":1505484300,"tags":{"host":"a"}}
+,{"metric":"latency.mean","value":50.5,"timestamp":1505484300,"tags":{"host":"a"}}
+,{"metric":"latency.std-dev","value":28.86607004772212,"timestamp":1505484300,"tags":{"host":"a"}}
+,{"metric":"latency.p50","value":50.5,"timestamp":1505484300,"tags":{"host":"a"}}
+,{"metric":"latency.p75","value":75.75,"timestamp":1505484300,"tags":{"host":"a"}}
+,{"metric":"latency.p95","value":90.9,"timestamp":1505484300,"tags":{"host":"a"}}
+,{"metric":"latency.p99","value":95.94999999999999,"timestamp":1505484300,"tags":{"host":"a"}}
+,{"metric":"latency.p999","value":99.99,"timestamp":1505484300,"tags":{"host":"a"}}
+]`
+
+func goldenRegistry() TaggedRegistry {
+	r := NewTaggedRegistry()
+	h := metrics.NewHistogram(metrics.NewUniformSample(100))
+	for i := int64(1); i <= 100; i++ {
+		h.Update(i)
+	}
+	r.Register("latency", Tags{"host": "a"}, h)
+	return r
+}
+
+// runGolden runs e on a fake clock until its first scheduled flush and
+// returns the flush result.
+func runGolden(t *testing.T, e *TaggedOpenTSDB) FlushResult {
+	clock := NewFakeClock(time.Date(2017, 9, 15, 14, 4, 53, 0, time.UTC))
+	results := make(chan FlushResult, 1)
+	e.Clock = clock
+	e.FlushInterval = 10 * time.Second
+	e.AlignFlushes = true
+	e.Logger = log.New()
+	e.OnFlush = func(res FlushResult) { results <- res }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(7 * time.Second)
+	res := <-results
+
+	cancel()
+	<-results
+	<-done
+	return res
+}
+
+func TestGoldenTcollector(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan []byte, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			received <- b
+		}
+	}()
+
+	res := runGolden(t, &TaggedOpenTSDB{Addr: l.Addr().String(), Registry: goldenRegistry(), Format: Tcollector, DurationUnit: time.Millisecond})
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if b := <-received; string(b) != goldenTcollector {
+		t.Errorf("Expected:\n%s\ngot:\n%s", goldenTcollector, b)
+	}
+}
+
+func TestGoldenJSON(t *testing.T) {
+	received := make(chan []byte, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- b
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	res := runGolden(t, &TaggedOpenTSDB{Addr: ts.URL, Registry: goldenRegistry(), Format: Json})
+	if res.Err != nil || res.Points != 10 {
+		t.Fatalf("Unexpected flush result: %+v", res)
+	}
+	if b := <-received; !bytes.Equal(b, []byte(goldenJSON)) {
+		t.Errorf("Expected:\n%s\ngot:\n%s", goldenJSON, b)
+	}
+}
@@ -0,0 +1,190 @@
+package tsdmetrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TagMatchType is the way a TagMatcher compares a tag value.
+type TagMatchType int
+
+const (
+	TagEqual    TagMatchType = iota // Tag set to Value
+	TagNotEqual                     // Tag absent or not set to Value
+	TagRegex                        // Tag value fully matches the Value regex
+	TagNotRegex                     // Tag absent or not matching the Value regex
+	TagPresent                      // Tag set, whatever its value
+	TagAbsent                       // Tag not set
+)
+
+var tagMatchTypeNames = []string{"equal", "not_equal", "regex", "not_regex", "present", "absent"}
+
+func (m TagMatchType) String() string {
+	if int(m) >= 0 && int(m) < len(tagMatchTypeNames) {
+		return tagMatchTypeNames[m]
+	}
+	return fmt.Sprintf("TagMatchType(%d)", int(m))
+}
+
+func (m TagMatchType) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText parses a match type from its name as returned by String.
+func (m *TagMatchType) UnmarshalText(b []byte) error {
+	for i, name := range tagMatchTypeNames {
+		if string(b) == name {
+			*m = TagMatchType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown tag match type: %s", b)
+}
+
+// TagMatcher matches a series on one of its tags.
+type TagMatcher struct {
+	Key   string       `yaml:"key" json:"key"`
+	Type  TagMatchType `yaml:"type" json:"type"`
+	Value string       `yaml:"value" json:"value"`
+
+	re *regexp.Regexp
+}
+
+// SeriesMatcher matches a series when both its name and all its tag
+// matchers match. Names are full OpenTSDB metric names, derived series
+// suffixes like ".p99" or ".std-dev" included.
+type SeriesMatcher struct {
+	Name      string       `yaml:"name" json:"name"`             // Glob where * matches any sequence and ? any character, empty for any
+	NameRegex string       `yaml:"name_regex" json:"name_regex"` // Regex fully matching the name, used when Name is empty
+	Tags      []TagMatcher `yaml:"tags" json:"tags"`
+
+	re *regexp.Regexp
+}
+
+// SeriesFilter selects the series exported. It only applies to the export,
+// the registry keeps all its metrics. A SeriesFilter must not be modified
+// once given to an exporter.
+type SeriesFilter struct {
+	Allow []SeriesMatcher `yaml:"allow" json:"allow"` // When not empty, only series matching one of them are exported
+	Deny  []SeriesMatcher `yaml:"deny" json:"deny"`   // Series matching one of them are never exported
+
+	compiled bool
+}
+
+// Compile checks the patterns of the filter. Exporters compile their filter
+// on first use, calling it beforehand reports configuration errors early.
+func (f *SeriesFilter) Compile() error {
+	if f.compiled {
+		return nil
+	}
+	for _, matchers := range [][]SeriesMatcher{f.Allow, f.Deny} {
+		for i := range matchers {
+			if err := matchers[i].compile(); err != nil {
+				return err
+			}
+		}
+	}
+	f.compiled = true
+	return nil
+}
+
+// Match tells if a series is exported.
+func (f *SeriesFilter) Match(name string, tags Tags) bool {
+	for i := range f.Deny {
+		if f.Deny[i].Match(name, tags) {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for i := range f.Allow {
+		if f.Allow[i].Match(name, tags) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *SeriesMatcher) compile() error {
+	var err error
+	switch {
+	case m.Name != "":
+		m.re, err = regexp.Compile(globToRegex(m.Name))
+	case m.NameRegex != "":
+		m.re, err = regexp.Compile("^(?:" + m.NameRegex + ")$")
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid series name pattern: %s", err)
+	}
+
+	for i := range m.Tags {
+		if err := m.Tags[i].compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match tells if the series matches.
+func (m *SeriesMatcher) Match(name string, tags Tags) bool {
+	if m.re != nil && !m.re.MatchString(name) {
+		return false
+	}
+	for i := range m.Tags {
+		if !m.Tags[i].Match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *TagMatcher) compile() error {
+	if m.Type != TagRegex && m.Type != TagNotRegex {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + m.Value + ")$")
+	if err != nil {
+		return fmt.Errorf("Invalid regex for tag %s: %s", m.Key, err)
+	}
+	m.re = re
+	return nil
+}
+
+// Match tells if tags match.
+func (m *TagMatcher) Match(tags Tags) bool {
+	v, ok := tags[m.Key]
+	switch m.Type {
+	case TagEqual:
+		return ok && v == m.Value
+	case TagNotEqual:
+		return !ok || v != m.Value
+	case TagRegex:
+		return ok && m.re.MatchString(v)
+	case TagNotRegex:
+		return !ok || !m.re.MatchString(v)
+	case TagPresent:
+		return ok
+	case TagAbsent:
+		return !ok
+	}
+	return false
+}
+
+func globToRegex(glob string) string {
+	var b strings.Builder
+	b.WriteByte('^')
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteByte('$')
+	return b.String()
+}
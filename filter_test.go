@@ -0,0 +1,96 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSeriesFilter(t *testing.T) {
+	r := NewTaggedRegistry()
+	r.Register("app.requests", Tags{"host": "a", "env": "prod"}, metrics.NewCounter())
+	r.Register("app.requests", Tags{"host": "b", "env": "dev"}, metrics.NewCounter())
+	r.Register("app.latency", Tags{"host": "a"}, metrics.NewHistogram(metrics.NewUniformSample(10)))
+	r.Register("debug.queue", Tags{"host": "a"}, metrics.NewGauge())
+
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{
+		Writer:   &buf,
+		Registry: r,
+		Format:   JsonLines,
+		Filter: &SeriesFilter{
+			Allow: []SeriesMatcher{{NameRegex: `app\..*`}},
+			Deny: []SeriesMatcher{
+				{Name: "*.std-dev"},
+				{Name: "*.p??"},
+				{Tags: []TagMatcher{{Key: "env", Type: TagRegex, Value: "dev|test"}}},
+			},
+		},
+		Logger: log.New(),
+		Clock:  NewFakeClock(time.Unix(1505484300, 0)),
+	}
+
+	if err := e.Filter.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	var exported []string
+	e.eachJSONPoint(0, func(p *point) {
+		exported = append(exported, p.Metric()+" "+p.tags["host"])
+	})
+
+	expected := map[string]bool{
+		"app.requests a":      true,
+		"app.latency.count a": true,
+		"app.latency.min a":   true,
+		"app.latency.max a":   true,
+		"app.latency.mean a":  true,
+		"app.latency.p999 a":  true,
+	}
+	if len(exported) != len(expected) {
+		t.Fatalf("Expected %d series, got %v", len(expected), exported)
+	}
+	for _, s := range exported {
+		if !expected[s] {
+			t.Errorf("Unexpected series exported: %s", s)
+		}
+	}
+
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Get("debug.queue", Tags{"host": "a"}) == nil {
+		t.Error("Filtered metrics must stay registered")
+	}
+}
+
+func TestTagMatchers(t *testing.T) {
+	tags := Tags{"host": "a"}
+	for _, c := range []struct {
+		m     TagMatcher
+		match bool
+	}{
+		{TagMatcher{Key: "host", Type: TagEqual, Value: "a"}, true},
+		{TagMatcher{Key: "host", Type: TagNotEqual, Value: "a"}, false},
+		{TagMatcher{Key: "dc", Type: TagNotEqual, Value: "a"}, true},
+		{TagMatcher{Key: "host", Type: TagRegex, Value: "[a-c]"}, true},
+		{TagMatcher{Key: "host", Type: TagNotRegex, Value: "[a-c]"}, false},
+		{TagMatcher{Key: "host", Type: TagPresent}, true},
+		{TagMatcher{Key: "dc", Type: TagPresent}, false},
+		{TagMatcher{Key: "dc", Type: TagAbsent}, true},
+	} {
+		if err := c.m.compile(); err != nil {
+			t.Fatal(err)
+		}
+		if c.m.Match(tags) != c.match {
+			t.Errorf("%+v: expected %v", c.m, c.match)
+		}
+	}
+
+	f := &SeriesFilter{Deny: []SeriesMatcher{{NameRegex: "("}}}
+	if err := f.Compile(); err == nil {
+		t.Error("Expected an invalid regex to be reported")
+	}
+}
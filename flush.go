@@ -0,0 +1,74 @@
+package tsdmetrics
+
+import (
+	"context"
+	"time"
+)
+
+// FlushResult describes the outcome of a flush.
+type FlushResult struct {
+	Timestamp   time.Time     // Timestamp of the exported points
+	Duration    time.Duration // Time spent flushing
+	Points      int64         // Points accepted by the server
+	Bytes       int64         // Bytes sent
+	FailedBulks int64         // Bulks which could not be delivered
+	Rejected    int64         // Points refused by the server
+	Sanitized   int64         // Points corrected by Validation
+	Invalid     int64         // Points dropped by Validation
+	Suppressed  int64         // Points skipped as unchanged
+	Shed        int64         // Points dropped by RateLimit
+	Annotations int64         // Annotations accepted by the server
+	Err         error
+}
+
+func (s *flushStats) result(ts time.Time, duration time.Duration, err error) FlushResult {
+	return FlushResult{
+		Timestamp:   ts,
+		Duration:    duration,
+		Points:      s.points,
+		Bytes:       s.bytes,
+		FailedBulks: s.failedBulks,
+		Rejected:    s.rejected,
+		Sanitized:   s.sanitized,
+		Invalid:     s.invalid,
+		Suppressed:  s.suppressed,
+		Shed:        s.shed,
+		Annotations: s.annotations,
+		Err:         err,
+	}
+}
+
+type flushRequest struct {
+	ctx  context.Context
+	done chan error
+}
+
+// Flush exports the registry now and waits for the export to complete. When
+// the exporter is running, the flush goes through the run loop, with its
+// collectors and hooks, and never overlaps a scheduled flush. Otherwise the
+// registry is exported directly.
+func (t *TaggedOpenTSDB) Flush(ctx context.Context) error {
+	l := t.getLifecycle()
+	l.mutex.Lock()
+	running, stopped := l.running, l.stopped
+	l.mutex.Unlock()
+
+	if running {
+		req := flushRequest{ctx: ctx, done: make(chan error, 1)}
+		select {
+		case l.flushes <- req:
+			select {
+			case err := <-req.done:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-stopped:
+			// The loop is gone, export directly.
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return t.taggedOpenTSDB(ctx, t.clock().Now()).Err
+}
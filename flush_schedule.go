@@ -0,0 +1,135 @@
+package tsdmetrics
+
+import (
+	"math/rand"
+	"time"
+)
+
+// flushSchedule computes when the run loops flush and the timestamp carried
+// by the points of each flush.
+//
+// When aligned, flushes happen on interval boundaries as computed by
+// time.Truncate (:00, :10, :20... for 10s), shifted by a splay picked once per
+// schedule, and points are stamped with the boundary itself so they line up
+// across hosts whatever the splay.
+type flushSchedule struct {
+	interval time.Duration
+	align    bool
+	splay    time.Duration
+	next     time.Time // Boundary of the upcoming flush
+}
+
+func (t *TaggedOpenTSDB) newFlushSchedule(now time.Time) *flushSchedule {
+	var splay time.Duration
+	if t.FlushSplay > 0 {
+		splay = time.Duration(rand.Int63n(int64(t.FlushSplay)))
+	}
+	return newIntervalSchedule(now, t.FlushInterval, t.AlignFlushes, splay)
+}
+
+func newIntervalSchedule(now time.Time, interval time.Duration, align bool, splay time.Duration) *flushSchedule {
+	s := &flushSchedule{interval: interval, align: align, splay: splay}
+	if s.align {
+		s.next = now.Truncate(s.interval).Add(s.interval)
+	} else {
+		s.next = now.Add(s.interval)
+	}
+	return s
+}
+
+// wait returns how long to sleep until the upcoming flush.
+func (s *flushSchedule) wait(now time.Time) time.Duration {
+	if d := s.next.Add(s.splay).Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// advance returns the timestamp of the flush which is due at now and moves
+// the schedule to the following one. Like a time.Ticker, it skips the flushes
+// which were missed because the previous one took too long.
+func (s *flushSchedule) advance(now time.Time) time.Time {
+	stamp := now
+	if s.align {
+		stamp = s.next
+	}
+	if s.interval <= 0 {
+		return stamp
+	}
+
+	for !s.next.Add(s.splay).After(now) {
+		s.next = s.next.Add(s.interval)
+	}
+	return stamp
+}
+
+// exportSchedule runs one flushSchedule per export interval, sharing the
+// alignment and splay of the FlushInterval one.
+type exportSchedule struct {
+	def       *flushSchedule
+	intervals map[time.Duration]*flushSchedule
+	last      time.Time // Timestamp of the latest flush
+}
+
+func (t *TaggedOpenTSDB) newExportSchedule(now time.Time) *exportSchedule {
+	t.flushMutex.Lock()
+	def := t.newFlushSchedule(now)
+	t.flushMutex.Unlock()
+	return &exportSchedule{
+		def:       def,
+		intervals: map[time.Duration]*flushSchedule{def.interval: def},
+	}
+}
+
+// add schedules the flushes of the metrics exported every interval.
+func (e *exportSchedule) add(now time.Time, interval time.Duration) {
+	if _, ok := e.intervals[interval]; !ok && interval > 0 {
+		e.intervals[interval] = newIntervalSchedule(now, interval, e.def.align, e.def.splay)
+	}
+}
+
+// wait returns how long to sleep until the upcoming flush of any interval.
+func (e *exportSchedule) wait(now time.Time) time.Duration {
+	wait := e.def.wait(now)
+	for _, s := range e.intervals {
+		if w := s.wait(now); w < wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// advance returns the timestamp of the flush which is due at now along with
+// the intervals it must export, and moves their schedules forward.
+func (e *exportSchedule) advance(now time.Time) (time.Time, map[time.Duration]bool) {
+	var stamp time.Time
+	due := make(map[time.Duration]bool, len(e.intervals))
+	for interval, s := range e.intervals {
+		if s.wait(now) > 0 {
+			continue
+		}
+		ts := s.advance(now)
+		if stamp.IsZero() || ts.After(stamp) {
+			stamp = ts
+		}
+		due[interval] = true
+	}
+	return e.unique(stamp), due
+}
+
+// stamp returns the timestamp of a flush happening off schedule at now.
+func (e *exportSchedule) stamp(now time.Time) time.Time {
+	return e.unique(now)
+}
+
+// unique records ts as the timestamp of a flush, moving it one second past
+// the previous flush when both would land on the same second: OpenTSDB keeps
+// a single value per series and second, so a Flush right after an aligned
+// flush would otherwise overwrite its points.
+func (e *exportSchedule) unique(ts time.Time) time.Time {
+	if !e.last.IsZero() && ts.Unix() <= e.last.Unix() {
+		ts = e.last.Truncate(time.Second).Add(time.Second)
+	}
+	e.last = ts
+	return ts
+}
@@ -0,0 +1,36 @@
+package tsdmetrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlignedFlushSchedule(t *testing.T) {
+	e := &TaggedOpenTSDB{FlushInterval: 10 * time.Second, AlignFlushes: true, FlushSplay: 2 * time.Second}
+	start := time.Date(2017, 9, 15, 14, 4, 53, 0, time.UTC)
+	s := e.newFlushSchedule(start)
+
+	if s.splay < 0 || s.splay >= 2*time.Second {
+		t.Fatalf("Splay out of bounds: %s", s.splay)
+	}
+	if w := s.wait(start); w != 7*time.Second+s.splay {
+		t.Errorf("Expected to wait until the next boundary plus splay, got %s", w)
+	}
+
+	fire := start.Add(s.wait(start))
+	if stamp := s.advance(fire); !stamp.Equal(time.Date(2017, 9, 15, 14, 5, 0, 0, time.UTC)) {
+		t.Errorf("Points should be stamped with the boundary, got %s", stamp)
+	}
+
+	// A flush taking 25s skips the boundaries it missed.
+	late := fire.Add(25 * time.Second)
+	if w := s.wait(late); w != 0 {
+		t.Errorf("Expected an immediate flush, got %s", w)
+	}
+	if stamp := s.advance(late); !stamp.Equal(time.Date(2017, 9, 15, 14, 5, 10, 0, time.UTC)) {
+		t.Errorf("Unexpected stamp after a late flush: %s", stamp)
+	}
+	if !s.next.Equal(time.Date(2017, 9, 15, 14, 5, 30, 0, time.UTC)) {
+		t.Errorf("Unexpected next boundary: %s", s.next)
+	}
+}
@@ -0,0 +1,120 @@
+package tsdmetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Status describes how well the exporter delivers metrics.
+type Status struct {
+	LastAttempt         time.Time // Start of the last flush, zero before the first one
+	LastSuccess         time.Time // Start of the last flush without failures
+	ConsecutiveFailures int
+	LastError           error // Error of the last failed flush, nil after a success
+	QueueDepth          int   // One-shot metrics waiting for the next flush
+	PendingAnnotations  int   // Annotations waiting for the next flush
+}
+
+// exporterStatus is the Status maintained by the flushes.
+type exporterStatus struct {
+	mutex   sync.Mutex
+	status  Status
+	started time.Time // When the exporter started, the reference for staleness before a success
+}
+
+// markStarted records now as the start of the exporter unless it already
+// started.
+func (t *TaggedOpenTSDB) markStarted(now time.Time) {
+	t.health.mutex.Lock()
+	defer t.health.mutex.Unlock()
+	if t.health.started.IsZero() {
+		t.health.started = now
+	}
+}
+
+// updateStatus records the outcome of a flush which started at start.
+func (t *TaggedOpenTSDB) updateStatus(start time.Time, result FlushResult) {
+	t.markStarted(start)
+
+	s := &t.health
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.status.LastAttempt = start
+
+	err := result.Err
+	if err == nil && result.FailedBulks > 0 {
+		err = fmt.Errorf("%d bulks failed", result.FailedBulks)
+	}
+	if err != nil {
+		s.status.ConsecutiveFailures++
+		s.status.LastError = err
+		return
+	}
+	s.status.LastSuccess = start
+	s.status.ConsecutiveFailures = 0
+	s.status.LastError = nil
+}
+
+// Status returns the delivery status of the exporter.
+func (t *TaggedOpenTSDB) Status() Status {
+	t.health.mutex.Lock()
+	status := t.health.status
+	t.health.mutex.Unlock()
+
+	if t.Registry != nil {
+		status.QueueDepth = pending(t.Registry)
+	}
+	status.PendingAnnotations = t.pendingAnnotations()
+	return status
+}
+
+// HealthHandler returns an http.Handler answering 200 when the last
+// successful flush happened less than maxStaleness ago and 503 otherwise,
+// with the Status as Json. Before the first successful flush, staleness is
+// measured from the start of Run or the creation of the handler, whichever
+// came first, so an exporter which never manages to flush turns unhealthy.
+func (t *TaggedOpenTSDB) HealthHandler(maxStaleness time.Duration) http.Handler {
+	t.markStarted(t.clock().Now())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := t.Status()
+		t.health.mutex.Lock()
+		since := t.health.started
+		t.health.mutex.Unlock()
+		if !status.LastSuccess.IsZero() {
+			since = status.LastSuccess
+		}
+
+		code := http.StatusOK
+		if t.clock().Now().Sub(since) > maxStaleness {
+			code = http.StatusServiceUnavailable
+		}
+
+		body := struct {
+			Healthy             bool      `json:"healthy"`
+			LastAttempt         time.Time `json:"last_attempt"`
+			LastSuccess         time.Time `json:"last_success"`
+			ConsecutiveFailures int       `json:"consecutive_failures"`
+			LastError           string    `json:"last_error,omitempty"`
+			QueueDepth          int       `json:"queue_depth"`
+			PendingAnnotations  int       `json:"pending_annotations"`
+		}{
+			Healthy:             code == http.StatusOK,
+			LastAttempt:         status.LastAttempt,
+			LastSuccess:         status.LastSuccess,
+			ConsecutiveFailures: status.ConsecutiveFailures,
+			QueueDepth:          status.QueueDepth,
+			PendingAnnotations:  status.PendingAnnotations,
+		}
+		if status.LastError != nil {
+			body.LastError = status.LastError.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	})
+}
@@ -0,0 +1,103 @@
+package tsdmetrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+type failingWriter struct {
+	fail bool
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.fail {
+		return 0, errors.New("broken pipe")
+	}
+	return len(b), nil
+}
+
+func TestHealth(t *testing.T) {
+	r := NewTaggedRegistry()
+	r.Register("test", Tags{"host": "a"}, metrics.NewCounter())
+
+	w := &failingWriter{}
+	clock := NewFakeClock(time.Unix(1505484300, 0))
+	e := &TaggedOpenTSDB{Writer: w, Registry: r, Logger: log.New(), Clock: clock}
+	h := e.HealthHandler(time.Minute)
+
+	check := func(expected int) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		if rec.Code != expected {
+			t.Errorf("Expected %d, got %d: %s", expected, rec.Code, rec.Body.String())
+		}
+	}
+
+	check(http.StatusOK)
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+	success := clock.Now()
+
+	w.fail = true
+	for i := 0; i < 2; i++ {
+		clock.Advance(40 * time.Second)
+		if err := e.Export(); err == nil {
+			t.Fatal("Expected the export to fail")
+		}
+	}
+	r.Add("oneshot", Tags{"host": "a"}, metrics.NewCounter())
+
+	s := e.Status()
+	if !s.LastSuccess.Equal(success) || !s.LastAttempt.Equal(clock.Now()) || s.ConsecutiveFailures != 2 ||
+		s.LastError == nil || s.QueueDepth != 1 {
+		t.Errorf("Unexpected status: %+v", s)
+	}
+	check(http.StatusServiceUnavailable)
+
+	w.fail = false
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if s := e.Status(); s.ConsecutiveFailures != 0 || s.LastError != nil {
+		t.Errorf("Expected the failures to be reset, got %+v", s)
+	}
+	check(http.StatusOK)
+}
+
+func TestHealthWithoutFlush(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1505484300, 0))
+	e := &TaggedOpenTSDB{Writer: &failingWriter{}, Registry: NewTaggedRegistry(), FlushInterval: time.Hour, Logger: log.New(), Clock: clock}
+	h := e.HealthHandler(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	clock.BlockUntil(1)
+
+	for _, c := range []struct {
+		after    time.Duration
+		expected int
+	}{{30 * time.Second, http.StatusOK}, {time.Minute, http.StatusServiceUnavailable}} {
+		clock.Advance(c.after)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		if rec.Code != c.expected {
+			t.Errorf("Expected %d before any flush, got %d: %s", c.expected, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package tsdmetrics
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// SetIdleTTL makes the registry evict the series registered by GetOrRegister
+// which were neither updated nor looked up for ttl, as seen by EvictIdle.
+// Series registered with Register are kept as their owner may still use
+// them. onEvict, which may be nil, is called with every evicted series after
+// its removal. Calling r.Add(name, tm.GetTags(), tm.GetMetric()) from it has
+// the exporter report the final value of the series at its next flush.
+//
+// A ttl of 0 disables eviction.
+func (r *DefaultTaggedRegistry) SetIdleTTL(ttl time.Duration, onEvict func(name string, tm TaggedMetric)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.idleTTL = ttl
+	r.onEvict = onEvict
+}
+
+// RunEviction sweeps the registry for idle series every interval until ctx
+// is cancelled. It is meant to be run in its own goroutine.
+func (r *DefaultTaggedRegistry) RunEviction(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.EvictIdle(now)
+		}
+	}
+}
+
+// EvictIdle removes the series idle for the registry's TTL at now and returns
+// how many were evicted. A series is active when its value changed since the
+// previous sweep or when it was looked up with Get or GetOrRegister, so
+// series are idle for at least the TTL and at most the TTL plus the sweep
+// interval. Healthchecks are never evicted.
+func (r *DefaultTaggedRegistry) EvictIdle(now time.Time) int {
+	type evictedMetric struct {
+		name string
+		tm   TaggedMetric
+	}
+	var evicted []evictedMetric
+
+	r.mutex.Lock()
+	ttl, onEvict := r.idleTTL, r.onEvict
+	if ttl > 0 {
+		for name, t := range r.metrics {
+			for id, tm := range t {
+				m, ok := tm.(*DefaultTaggedMetric)
+				if !ok || !m.evictable {
+					continue
+				}
+				a, ok := activity(m.Metric)
+				if !ok {
+					continue
+				}
+				if m.lastActive.IsZero() || m.accessed || a != m.activity {
+					m.lastActive, m.activity, m.accessed = now, a, false
+					continue
+				}
+				if now.Sub(m.lastActive) >= ttl {
+					delete(t, id)
+					r.series--
+					evicted = append(evicted, evictedMetric{name, m})
+				}
+			}
+			if len(t) == 0 {
+				delete(r.metrics, name)
+			}
+		}
+	}
+	r.mutex.Unlock()
+
+	if onEvict != nil {
+		for _, e := range evicted {
+			onEvict(e.name, e.tm)
+		}
+	}
+	return len(evicted)
+}
+
+// touch records a lookup of tm for the idle tracking.
+func (r *DefaultTaggedRegistry) touch(tm TaggedMetric) {
+	if r.idleTTL > 0 {
+		if m, ok := tm.(*DefaultTaggedMetric); ok {
+			m.accessed = true
+		}
+	}
+}
+
+// activity returns a value which changes whenever i is updated, false for the
+// metrics which have none.
+func activity(i interface{}) (uint64, bool) {
+	switch metric := i.(type) {
+	case metrics.Counter:
+		return uint64(metric.Count()), true
+	case metrics.Gauge:
+		return uint64(metric.Value()), true
+	case metrics.GaugeFloat64:
+		return math.Float64bits(metric.Value()), true
+	case metrics.Histogram:
+		return uint64(metric.Count()), true
+	case metrics.Meter:
+		return uint64(metric.Count()), true
+	case metrics.Timer:
+		return uint64(metric.Count()), true
+	case IntegerHistogram:
+		return uint64(metric.Count()), true
+	}
+	return 0, false
+}
@@ -0,0 +1,82 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestIdleEviction(t *testing.T) {
+	r := NewTaggedRegistry().(*DefaultTaggedRegistry)
+	r.SetIdleTTL(time.Minute, func(name string, tm TaggedMetric) {
+		r.Add(name, tm.GetTags(), tm.GetMetric())
+	})
+
+	idle := r.GetOrRegister("requests", Tags{"customer": "idle"}, metrics.NewCounter).(metrics.Counter)
+	idle.Inc(3)
+	busy := r.GetOrRegister("requests", Tags{"customer": "busy"}, metrics.NewCounter).(metrics.Counter)
+	r.GetOrRegister("requests", Tags{"customer": "looked-up"}, metrics.NewCounter)
+	r.Register("registered", Tags{}, metrics.NewCounter())
+
+	start := time.Unix(1505484300, 0)
+	sweep := func(elapsed time.Duration) int {
+		busy.Inc(1)
+		r.Get("requests", Tags{"customer": "looked-up"})
+		return r.EvictIdle(start.Add(elapsed))
+	}
+	sweep(0)
+	idle.Inc(1)
+	for _, elapsed := range []time.Duration{30 * time.Second, time.Minute} {
+		if n := sweep(elapsed); n != 0 {
+			t.Fatalf("Expected nothing evicted after %s, got %d", elapsed, n)
+		}
+	}
+	if n := sweep(90 * time.Second); n != 1 {
+		t.Fatalf("Expected 1 series evicted, got %d", n)
+	}
+	if r.Get("requests", Tags{"customer": "idle"}) != nil {
+		t.Error("Expected the idle series to be evicted")
+	}
+	if r.Get("registered", Tags{}) == nil {
+		t.Error("Expected series from Register to be kept")
+	}
+
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{Writer: &buf, Registry: r, Logger: log.New(), Clock: NewFakeClock(start)}
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("put requests 1505484300 4 customer=idle")) {
+		t.Errorf("Expected the final value of the evicted series, got:\n%s", buf.String())
+	}
+}
+
+func TestIdleEvictionDuringExport(t *testing.T) {
+	r := NewTaggedRegistry().(*DefaultTaggedRegistry)
+	r.SetIdleTTL(time.Second, nil)
+	for i := 0; i < 100; i++ {
+		r.GetOrRegister("requests", Tags{"customer": strconv.Itoa(i)}, metrics.NewCounter)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		now := time.Unix(1505484300, 0)
+		for i := 0; i < 100; i++ {
+			r.EvictIdle(now.Add(time.Duration(i) * time.Second))
+		}
+	}()
+
+	e := &TaggedOpenTSDB{Writer: ioutil.Discard, Registry: r, Format: JsonLines, Logger: log.New()}
+	for i := 0; i < 10; i++ {
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
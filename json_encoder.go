@@ -0,0 +1,155 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// jsonBulkEncoder streams points into JSON arrays of at most bulkSize points
+// and maxBytes bytes. Every bulk is handed to send as soon as it is complete,
+// so memory use is bounded by the bulk size instead of the size of the
+// registry. Transport errors are send's business: they only affect the bulk
+// being sent.
+//
+// When compressing, maxBytes limits the compressed body. Its size is only
+// known once the compressor is flushed, so the encoder assumes the worst case
+// expansion for the data it has not flushed yet, and flushes it to get the
+// real size when that assumption would overflow the limit. Bulks can
+// therefore close somewhat before the limit, never after it. A single point
+// which does not fit in maxBytes on its own is sent in a bulk of its own.
+type jsonBulkEncoder struct {
+	bulkSize int // Maximum points per bulk, 0 for no limit
+	maxBytes int // Maximum body size per bulk, 0 for no limit
+	send     func(body *bytes.Buffer, points int)
+
+	buf     *bytes.Buffer // Body of the current bulk
+	cw      compressor    // nil when not compressing
+	w       io.Writer
+	pt      bytes.Buffer // Serialized point waiting to be added
+	enc     *json.Encoder
+	pending int // Bytes written to cw since it was last flushed
+	count   int // Points in the current bulk
+	total   int // Points encoded since creation
+	err     error
+}
+
+// newJSONBulkEncoder creates an encoder compressing bulks with cw, which can
+// be nil. cw is reset for every bulk and left closed by the last one.
+func newJSONBulkEncoder(bulkSize, maxBytes int, cw compressor, send func(body *bytes.Buffer, points int)) *jsonBulkEncoder {
+	e := &jsonBulkEncoder{bulkSize: bulkSize, maxBytes: maxBytes, cw: cw, send: send}
+	e.enc = json.NewEncoder(&e.pt)
+	e.reset()
+	return e
+}
+
+// reset starts a new bulk. The previous buffer is left to the transport,
+// which may still be reading from it after send returns.
+func (e *jsonBulkEncoder) reset() {
+	e.buf = &bytes.Buffer{}
+	e.w = e.buf
+	if e.cw != nil {
+		e.cw.Reset(e.buf)
+		e.w = e.cw
+	}
+	e.pending = 0
+	e.count = 0
+}
+
+// Encode appends p to the current bulk, sending the bulk once it is full.
+// Serialization errors are sticky and returned by every following call.
+func (e *jsonBulkEncoder) Encode(p *point) error {
+	if e.err != nil {
+		return e.err
+	}
+
+	e.pt.Reset()
+	e.err = e.enc.Encode(p.openTSDBPoint())
+	if e.err != nil {
+		return e.err
+	}
+
+	// Separator and closing bracket included.
+	if e.count > 0 && !e.fits(e.pt.Len()+2) {
+		if e.err = e.flush(); e.err != nil {
+			return e.err
+		}
+	}
+
+	sep := byte(',')
+	if e.count == 0 {
+		sep = '['
+	}
+	if e.err = e.write([]byte{sep}); e.err != nil {
+		return e.err
+	}
+	if e.err = e.write(e.pt.Bytes()); e.err != nil {
+		return e.err
+	}
+	e.count++
+	e.total++
+
+	if e.bulkSize > 0 && e.count >= e.bulkSize {
+		e.err = e.flush()
+	}
+	return e.err
+}
+
+// Close sends the last, partially filled bulk.
+func (e *jsonBulkEncoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.flush()
+}
+
+// fits tells if n more uncompressed bytes can be added to the current bulk
+// without going over maxBytes.
+func (e *jsonBulkEncoder) fits(n int) bool {
+	if e.maxBytes <= 0 {
+		return true
+	}
+	if e.cw == nil {
+		return e.buf.Len()+n <= e.maxBytes
+	}
+
+	if e.buf.Len()+maxCompressedLen(e.pending+n) <= e.maxBytes {
+		return true
+	}
+	if e.pending > 0 {
+		if err := e.cw.Flush(); err != nil {
+			return false
+		}
+		e.pending = 0
+		if b, ok := e.cw.(interface{ Buffered() int }); ok {
+			e.pending = b.Buffered()
+		}
+	}
+	return e.buf.Len()+maxCompressedLen(e.pending+n) <= e.maxBytes
+}
+
+func (e *jsonBulkEncoder) write(b []byte) error {
+	_, err := e.w.Write(b)
+	e.pending += len(b)
+	return err
+}
+
+func (e *jsonBulkEncoder) flush() error {
+	if e.count == 0 {
+		return nil
+	}
+
+	if err := e.write([]byte{']'}); err != nil {
+		return err
+	}
+	if e.cw != nil {
+		if err := e.cw.Close(); err != nil {
+			return err
+		}
+	}
+
+	e.send(e.buf, e.count)
+	e.reset()
+
+	return nil
+}
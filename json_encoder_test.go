@@ -0,0 +1,214 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func testCompressor(t *testing.T, codec Compression) compressor {
+	if codec == NoCompression {
+		return nil
+	}
+	cw, err := getCompressor(codec, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cw
+}
+
+func decompress(t *testing.T, codec Compression, b []byte) io.Reader {
+	var r io.Reader = bytes.NewReader(b)
+	var err error
+	switch codec {
+	case Gzip:
+		r, err = gzip.NewReader(r)
+	case Deflate:
+		r, err = zlib.NewReader(r)
+	case Zstd:
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(r)
+		r = d
+	case Snappy:
+		var raw []byte
+		raw, err = snappy.Decode(nil, b)
+		r = bytes.NewReader(raw)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func decodeBulks(t *testing.T, bulks []*bytes.Buffer, codec Compression) [][]OpenTSDBPoint {
+	var decoded [][]OpenTSDBPoint
+	for _, b := range bulks {
+		r := decompress(t, codec, b.Bytes())
+
+		var pts []OpenTSDBPoint
+		if err := json.NewDecoder(r).Decode(&pts); err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, pts)
+	}
+	return decoded
+}
+
+func TestJSONBulkEncoder(t *testing.T) {
+	for _, codec := range []Compression{NoCompression, Gzip, Deflate, Zstd, Snappy} {
+		var bulks []*bytes.Buffer
+		enc := newJSONBulkEncoder(3, 0, testCompressor(t, codec), func(b *bytes.Buffer, n int) {
+			bulks = append(bulks, b)
+		})
+
+		p := point{name: "test", tags: Tags{"host": "a"}, timestamp: 10}
+		for i := int64(0); i < 7; i++ {
+			p.ival = i
+			if err := enc.Encode(&p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := decodeBulks(t, bulks, codec)
+		if len(decoded) != 3 {
+			t.Fatalf("Expected 3 bulks, got %d", len(decoded))
+		}
+		for i, n := range []int{3, 3, 1} {
+			if len(decoded[i]) != n {
+				t.Errorf("Expected %d points in bulk %d, got %d", n, i, len(decoded[i]))
+			}
+		}
+		if last := decoded[2][0]; last.Metric != "test" || last.Value.(float64) != 6 || last.Tags["host"] != "a" {
+			t.Errorf("Unexpected last point: %+v", last)
+		}
+	}
+}
+
+func TestJSONBulkEncoderEmpty(t *testing.T) {
+	enc := newJSONBulkEncoder(0, 0, nil, func(b *bytes.Buffer, n int) {
+		t.Error("Nothing should be sent")
+	})
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONBulkEncoderMaxBytes(t *testing.T) {
+	for _, codec := range []Compression{NoCompression, Gzip, Deflate, Zstd, Snappy} {
+		var bulks []*bytes.Buffer
+		enc := newJSONBulkEncoder(0, 512, testCompressor(t, codec), func(b *bytes.Buffer, n int) {
+			bulks = append(bulks, b)
+		})
+
+		p := point{name: "test", timestamp: 10}
+		for i := int64(0); i < 200; i++ {
+			p.tags = Tags{"id": fmt.Sprintf("%d", i*7919)}
+			p.ival = i
+			if err := enc.Encode(&p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, b := range bulks {
+			if b.Len() > 512 {
+				t.Errorf("Bulk of %d bytes is over the limit (%s)", b.Len(), codec)
+			}
+		}
+
+		n := 0
+		for _, pts := range decodeBulks(t, bulks, codec) {
+			n += len(pts)
+		}
+		if n != 200 {
+			t.Errorf("Expected 200 points, got %d (%s)", n, codec)
+		}
+	}
+}
+
+func TestJSONBulkEncoderOversizedPoint(t *testing.T) {
+	var bulks []*bytes.Buffer
+	enc := newJSONBulkEncoder(0, 16, nil, func(b *bytes.Buffer, n int) {
+		bulks = append(bulks, b)
+	})
+
+	p := point{name: "a.long.metric.name", timestamp: 10}
+	enc.Encode(&p)
+	enc.Encode(&p)
+	enc.Close()
+
+	if len(bulks) != 2 {
+		t.Fatalf("Expected each oversized point in its own bulk, got %d bulks", len(bulks))
+	}
+}
+
+func TestCompressorPool(t *testing.T) {
+	var first bytes.Buffer
+	cw, err := getCompressor(Gzip, 9, &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw.Write([]byte("first"))
+	cw.Close()
+	putCompressor(Gzip, 9, cw)
+
+	var second bytes.Buffer
+	cw, err = getCompressor(Gzip, 9, &second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw.Write([]byte("second"))
+	cw.Close()
+
+	b, err := ioutil.ReadAll(decompress(t, Gzip, second.Bytes()))
+	if err != nil || string(b) != "second" {
+		t.Errorf("Unexpected content from a pooled compressor: %q %v", b, err)
+	}
+
+	if _, err := getCompressor(Gzip, 42, nil); err == nil {
+		t.Error("Invalid gzip level should be rejected")
+	}
+}
+
+func TestJSONEncodingFailure(t *testing.T) {
+	r := NewTaggedRegistry()
+	g := metrics.NewGaugeFloat64()
+	g.Update(math.NaN())
+	r.Register("nan", Tags{"host": "a"}, g)
+	r.Register("count", Tags{"host": "a"}, metrics.NewCounter())
+
+	var result FlushResult
+	e := &TaggedOpenTSDB{
+		Writer:            ioutil.Discard,
+		Registry:          r,
+		Format:            Json,
+		SuppressUnchanged: true,
+		OnFlush:           func(r FlushResult) { result = r },
+		Logger:            log.New(),
+	}
+	if err := e.Export(); err == nil {
+		t.Error("Expected the encoding failure to fail the flush")
+	}
+	if result.Err == nil || e.Status().ConsecutiveFailures != 1 {
+		t.Errorf("Expected the failure to be reported, got %+v", result)
+	}
+	if len(e.suppressor.last) != 0 {
+		t.Errorf("Expected the values which were not sent to be forgotten, got %d", len(e.suppressor.last))
+	}
+}
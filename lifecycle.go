@@ -0,0 +1,150 @@
+package tsdmetrics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errRunning = errors.New("TaggedOpenTSDB is already running")
+
+// lifecycle tracks the run loop of a TaggedOpenTSDB so it can be stopped and
+// waited for. The loop can be run again once its context is cancelled. Once
+// closed, it flushes a single time and returns right away.
+type lifecycle struct {
+	mutex     sync.Mutex
+	running   bool
+	closing   chan struct{} // Closed by Close
+	closeOnce sync.Once
+	stopped   chan struct{} // Closed when the current run loop returned
+	err       error         // Outcome of the last flush of the run loop
+	flushes   chan flushRequest
+	updates   chan struct{} // Signals a change of the flush schedule
+}
+
+func (t *TaggedOpenTSDB) getLifecycle() *lifecycle {
+	t.lifecycleOnce.Do(func() {
+		t.lifecycle = &lifecycle{
+			closing: make(chan struct{}),
+			flushes: make(chan flushRequest),
+			updates: make(chan struct{}, 1),
+		}
+	})
+	return t.lifecycle
+}
+
+// loop calls flush on the flush schedule until ctx is cancelled or Close is
+// called. Scheduled flushes only export the metrics of the intervals which
+// are due, the others export everything. The schedule starts over when Update
+// changes the settings. It then calls flush one last time with a context
+// bounded by ShutdownTimeout so that what was collected since the previous
+// flush, and the metrics queued with Add(), are not lost. It fails right away
+// when the loop is already running, and goes straight to that last flush when
+// the exporter is closed.
+func (t *TaggedOpenTSDB) loop(ctx context.Context, flush func(context.Context, time.Time) error) error {
+	l := t.getLifecycle()
+	l.mutex.Lock()
+	if l.running {
+		l.mutex.Unlock()
+		return errRunning
+	}
+	l.running = true
+	stopped := make(chan struct{})
+	l.stopped = stopped
+	l.mutex.Unlock()
+	defer func() {
+		l.mutex.Lock()
+		l.running = false
+		l.mutex.Unlock()
+		close(stopped)
+	}()
+
+	clock := t.clock()
+	t.markStarted(clock.Now())
+	s := t.newExportSchedule(clock.Now())
+	timer := clock.NewTimer(s.wait(clock.Now()))
+	defer timer.Stop()
+	tick := t.scheduledFlushes(s, timer)
+
+	for {
+		select {
+		case <-ctx.Done():
+			l.err = t.finalFlush(s, flush)
+			return nil
+		case <-l.closing:
+			l.err = t.finalFlush(s, flush)
+			return nil
+		case now := <-tick:
+			ts, due := s.advance(now)
+			flush(withDueIntervals(ctx, due), ts)
+			for _, interval := range t.exportIntervals() {
+				s.add(clock.Now(), interval)
+			}
+			timer.Reset(s.wait(clock.Now()))
+		case req := <-l.flushes:
+			req.done <- flush(req.ctx, s.stamp(clock.Now()))
+		case <-l.updates:
+			last := s.last
+			s = t.newExportSchedule(clock.Now())
+			s.last = last
+			for _, interval := range t.exportIntervals() {
+				s.add(clock.Now(), interval)
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C():
+				default:
+				}
+			}
+			timer.Reset(s.wait(clock.Now()))
+			tick = t.scheduledFlushes(s, timer)
+		}
+	}
+}
+
+// scheduledFlushes returns the channel of the flushes of s, or nil when it
+// has no valid interval so that, like time.Tick, the loop only flushes on
+// demand.
+func (t *TaggedOpenTSDB) scheduledFlushes(s *exportSchedule, timer Timer) <-chan time.Time {
+	if s.def.interval <= 0 {
+		t.Logger.Errorf("Not flushing on schedule, FlushInterval must be positive: %s", s.def.interval)
+		return nil
+	}
+	return timer.C()
+}
+
+// finalFlush exports what is left when the loop stops, stamped like an
+// on-demand flush so it cannot overwrite the points of the previous one.
+func (t *TaggedOpenTSDB) finalFlush(s *exportSchedule, flush func(context.Context, time.Time) error) error {
+	t.flushMutex.Lock()
+	timeout := t.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = t.FlushInterval
+	}
+	t.flushMutex.Unlock()
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return flush(ctx, s.stamp(t.clock().Now()))
+}
+
+// Close stops the run loop, waits for its last flush to complete and returns
+// the error of that flush. It returns immediately when the exporter is not
+// running, in which case a later Run only flushes once and returns.
+func (t *TaggedOpenTSDB) Close() error {
+	l := t.getLifecycle()
+	l.mutex.Lock()
+	l.closeOnce.Do(func() { close(l.closing) })
+	running, stopped := l.running, l.stopped
+	l.mutex.Unlock()
+	if !running {
+		return nil
+	}
+	<-stopped
+	return l.err
+}
@@ -0,0 +1,215 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCloseFlushesPendingMetrics(t *testing.T) {
+	var mutex sync.Mutex
+	var received []OpenTSDBPoint
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pts []OpenTSDBPoint
+		json.NewDecoder(r.Body).Decode(&pts)
+		mutex.Lock()
+		received = append(received, pts...)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	r := NewTaggedRegistry()
+	e := &TaggedOpenTSDB{
+		Addr:          ts.URL,
+		Registry:      r,
+		FlushInterval: time.Hour,
+		Format:        Json,
+		Logger:        log.New(),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.Run(context.Background())
+		close(done)
+	}()
+
+	c := metrics.NewCounter()
+	c.Inc(1)
+	r.Add("oneshot", Tags{"host": "a"}, c)
+
+	waitRunning(e)
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 1 || received[0].Metric != "oneshot" {
+		t.Errorf("Expected the one-shot metric to be flushed on close, got %+v", received)
+	}
+}
+
+func waitRunning(e *TaggedOpenTSDB) {
+	l := e.getLifecycle()
+	for {
+		l.mutex.Lock()
+		running := l.running
+		l.mutex.Unlock()
+		if running {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlushThroughRunLoop(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	r := NewTaggedRegistry()
+	r.Register("test", Tags{"host": "a"}, metrics.NewCounter())
+
+	var results []FlushResult
+	preprocessed := 0
+	e := &TaggedOpenTSDB{
+		Addr:          ts.URL,
+		Registry:      r,
+		FlushInterval: time.Hour,
+		Format:        Json,
+		Logger:        log.New(),
+		OnFlush:       func(res FlushResult) { results = append(results, res) },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.RunWithPreprocessing(ctx, []func(TaggedRegistry){func(TaggedRegistry) { preprocessed++ }})
+		close(done)
+	}()
+	waitRunning(e)
+
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if preprocessed != 1 || len(results) != 1 {
+		t.Fatalf("Expected one flush through the loop, got %d preprocessing and %d results", preprocessed, len(results))
+	}
+	if results[0].Points != 1 || results[0].Err != nil {
+		t.Errorf("Unexpected flush result: %+v", results[0])
+	}
+
+	cancel()
+	<-done
+	if len(results) != 2 {
+		t.Errorf("Expected a final flush on cancellation, got %d results", len(results))
+	}
+
+	// The loop is gone, Flush exports directly.
+	if err := e.Flush(context.Background()); err != nil || len(results) != 3 {
+		t.Errorf("Expected a direct flush, got %v and %d results", err, len(results))
+	}
+}
+
+func TestFlushAfterAlignedFlush(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1505484305, 0))
+	results := make(chan FlushResult, 1)
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{
+		Writer:        &buf,
+		Registry:      NewTaggedRegistry(),
+		FlushInterval: 10 * time.Second,
+		AlignFlushes:  true,
+		Clock:         clock,
+		Logger:        log.New(),
+		OnFlush:       func(res FlushResult) { results <- res },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(5 * time.Second)
+	if res := <-results; res.Timestamp.Unix() != 1505484310 {
+		t.Errorf("Unexpected timestamp of the scheduled flush: %s", res.Timestamp)
+	}
+
+	// Flushing within the same second must not overwrite the points of the
+	// scheduled flush.
+	go e.Flush(context.Background())
+	if res := <-results; res.Timestamp.Unix() != 1505484311 {
+		t.Errorf("Expected the flush to be stamped a second later, got %s", res.Timestamp)
+	}
+
+	// So must the final flush.
+	cancel()
+	if res := <-results; res.Timestamp.Unix() != 1505484312 {
+		t.Errorf("Expected the final flush to be stamped after the others, got %s", res.Timestamp)
+	}
+	<-done
+}
+
+func TestRunWithoutFlushInterval(t *testing.T) {
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{Writer: &buf, Registry: NewTaggedRegistry(), Clock: NewFakeClock(time.Unix(1505484300, 0)), Logger: log.New()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+	waitRunning(e)
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	<-done
+}
+
+func TestRunAgainAfterCancel(t *testing.T) {
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{Writer: &buf, Registry: NewTaggedRegistry(), FlushInterval: time.Hour, Logger: log.New()}
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			e.Run(ctx)
+			close(done)
+		}()
+		waitRunning(e)
+		if err := e.loop(context.Background(), nil); err != errRunning {
+			t.Errorf("Expected a second loop to be refused, got %v", err)
+		}
+		cancel()
+		<-done
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	flushes := 0
+	err := e.loop(context.Background(), func(context.Context, time.Time) error {
+		flushes++
+		return nil
+	})
+	if err != nil || flushes != 1 {
+		t.Errorf("Expected a closed exporter to flush once, got %v and %d flushes", err, flushes)
+	}
+}
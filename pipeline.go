@@ -0,0 +1,126 @@
+package tsdmetrics
+
+import (
+	"context"
+	"time"
+)
+
+// Pipeline configures the stages of the flushes of the run loop.
+//
+// Collectors run in order before each flush, transformers rewrite the series
+// of every export, and hooks run in order after each flush with its result.
+// Errors of collectors and hooks are logged and do not stop the flush.
+type Pipeline struct {
+	Collectors   []Collector
+	Transformers []Transformer
+	Hooks        []Hook
+}
+
+// Collector prepares the registry before a flush, for example by updating
+// gauges from an external source.
+type Collector interface {
+	Collect(ctx context.Context, r TaggedRegistry) error
+}
+
+// CollectorFunc is a function used as a Collector.
+type CollectorFunc func(ctx context.Context, r TaggedRegistry) error
+
+func (f CollectorFunc) Collect(ctx context.Context, r TaggedRegistry) error {
+	return f(ctx, r)
+}
+
+// Transformer rewrites the exported series. Transform returns the name and
+// tags a series is exported with, or false to drop it, and must not modify
+// tags. Transformers run after Relabeling and Filter and before Validation.
+//
+// A Transformer with a Compile() error method is compiled before each
+// export, which fails with its error.
+type Transformer interface {
+	Transform(name string, tags Tags) (string, Tags, bool)
+}
+
+// TransformerFunc is a function used as a Transformer.
+type TransformerFunc func(name string, tags Tags) (string, Tags, bool)
+
+func (f TransformerFunc) Transform(name string, tags Tags) (string, Tags, bool) {
+	return f(name, tags)
+}
+
+// Hook is told about the outcome of every flush of the run loop.
+type Hook interface {
+	AfterFlush(ctx context.Context, r TaggedRegistry, result FlushResult) error
+}
+
+// HookFunc is a function used as a Hook.
+type HookFunc func(ctx context.Context, r TaggedRegistry, result FlushResult) error
+
+func (f HookFunc) AfterFlush(ctx context.Context, r TaggedRegistry, result FlushResult) error {
+	return f(ctx, r, result)
+}
+
+// Transform implements Transformer.
+func (r *Relabeling) Transform(name string, tags Tags) (string, Tags, bool) {
+	return r.Relabel(name, tags)
+}
+
+// Transform implements Transformer.
+func (f *SeriesFilter) Transform(name string, tags Tags) (string, Tags, bool) {
+	return name, tags, f.Match(name, tags)
+}
+
+// runPipeline runs the loop with the stages of p around each flush.
+func (t *TaggedOpenTSDB) runPipeline(ctx context.Context, p Pipeline) {
+	err := t.loop(ctx, func(ctx context.Context, ts time.Time) error {
+		return t.flushPipeline(ctx, ts, p)
+	})
+	if err != nil {
+		t.Logger.Error(err)
+	}
+}
+
+func (t *TaggedOpenTSDB) flushPipeline(ctx context.Context, ts time.Time, p Pipeline) error {
+	for _, c := range p.Collectors {
+		if err := c.Collect(ctx, t.Registry); err != nil {
+			t.Logger.Errorf("Collector failed: %s", err)
+		}
+	}
+
+	result := t.taggedOpenTSDB(ctx, ts)
+	if result.Err != nil {
+		t.Logger.Error(result.Err)
+	}
+
+	for _, h := range p.Hooks {
+		if err := h.AfterFlush(ctx, t.Registry, result); err != nil {
+			t.Logger.Errorf("Flush hook failed: %s", err)
+		}
+	}
+	return result.Err
+}
+
+// compileTransformers checks the transformers of the exporter, and its
+// aggregation rules, before an export.
+func (t *TaggedOpenTSDB) compileTransformers() error {
+	if t.Aggregation != nil {
+		if err := t.Aggregation.Compile(); err != nil {
+			return err
+		}
+	}
+	transformers := []Transformer{}
+	if t.Relabeling != nil {
+		transformers = append(transformers, t.Relabeling)
+	}
+	if t.Filter != nil {
+		transformers = append(transformers, t.Filter)
+	}
+	for _, tr := range append(transformers, t.Pipeline.Transformers...) {
+		if c, ok := tr.(interface {
+			Compile() error
+		}); ok {
+			if err := c.Compile(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestPipeline(t *testing.T) {
+	r := NewTaggedRegistry()
+	g := metrics.NewGauge()
+	r.Register("queue", Tags{"host": "a"}, g)
+
+	var buf bytes.Buffer
+	var results []FlushResult
+	var order []string
+	e := &TaggedOpenTSDB{
+		Writer:        &buf,
+		Registry:      r,
+		FlushInterval: time.Hour,
+		Logger:        log.New(),
+		Clock:         NewFakeClock(time.Unix(1505484300, 0)),
+		Pipeline: Pipeline{
+			Collectors: []Collector{
+				CollectorFunc(func(ctx context.Context, r TaggedRegistry) error {
+					order = append(order, "failing collector")
+					return errors.New("collector failure")
+				}),
+				CollectorFunc(func(ctx context.Context, r TaggedRegistry) error {
+					order = append(order, "collector")
+					r.Get("queue", Tags{"host": "a"}).(metrics.Gauge).Update(7)
+					return nil
+				}),
+			},
+			Transformers: []Transformer{TransformerFunc(func(name string, tags Tags) (string, Tags, bool) {
+				return "app." + name, tags, true
+			})},
+			Hooks: []Hook{HookFunc(func(ctx context.Context, r TaggedRegistry, result FlushResult) error {
+				order = append(order, "hook")
+				results = append(results, result)
+				return nil
+			})},
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.RunWithProcessing(context.Background(), nil, []func(TaggedRegistry){func(TaggedRegistry) {
+			order = append(order, "postFn")
+		}})
+		close(done)
+	}()
+	waitRunning(e)
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if expected := "put app.queue 1505484300 7 host=a \n"; buf.String() != expected {
+		t.Errorf("Expected:\n%q\ngot:\n%q", expected, buf.String())
+	}
+	if len(results) != 1 || results[0].Points != 1 {
+		t.Errorf("Expected the hook to get the flush result, got %+v", results)
+	}
+	expected := []string{"failing collector", "collector", "hook", "postFn"}
+	if len(order) != len(expected) {
+		t.Fatalf("Expected stages %v, got %v", expected, order)
+	}
+	for i := range order {
+		if order[i] != expected[i] {
+			t.Fatalf("Expected stages %v, got %v", expected, order)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package tsdmetrics
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var exportedPercentiles = []float64{0.5, 0.75, 0.90, 0.95, 0.99}
+
+// point is a single OpenTSDB data point derived from a registered metric.
+// Walkers reuse the same point for every value they emit, so callbacks must
+// copy whatever they need to keep.
+type point struct {
+	name      string // Registry name
+	suffix    string // Derived series suffix (".p99", ".count", ...), may be empty
+	tags      Tags
+	tagsID    TagsID
+	timestamp int64
+
+	isFloat bool
+	ival    int64
+	fval    float64
+	prec    int // Decimals used by the Tcollector format for float values
+}
+
+// Metric returns the full OpenTSDB metric name of the point.
+func (p *point) Metric() string {
+	return p.name + p.suffix
+}
+
+// Value returns the value of the point as it will be serialized.
+func (p *point) Value() interface{} {
+	if p.isFloat {
+		return p.fval
+	}
+	return p.ival
+}
+
+func (p *point) openTSDBPoint() OpenTSDBPoint {
+	return OpenTSDBPoint{Metric: p.Metric(), Timestamp: p.timestamp, Value: p.Value(), Tags: p.tags}
+}
+
+func (p *point) emitInt(fn func(*point), suffix string, v int64) {
+	p.suffix, p.isFloat, p.ival = suffix, false, v
+	fn(p)
+}
+
+func (p *point) emitFloat(fn func(*point), suffix string, v float64) {
+	p.emitFloatPrec(fn, suffix, v, 2)
+}
+
+func (p *point) emitFloatPrec(fn func(*point), suffix string, v float64, prec int) {
+	p.suffix, p.isFloat, p.fval, p.prec = suffix, true, v, prec
+	fn(p)
+}
+
+// process wraps fn with the export-time processing of points, which applies
+// to every format. Series are relabeled, filtered on the result, given to the
+// transformers of the Pipeline, tagged with Tags, validated, skipped when
+// unchanged, and finally rate limited. Points shed by the rate limit are not
+// considered sent by the suppression of unchanged values.
+func (t *TaggedOpenTSDB) process(fn func(*point)) func(*point) {
+	stats := t.stats
+	if stats == nil {
+		stats = &flushStats{}
+	}
+
+	var sup *suppressor
+	if t.SuppressUnchanged {
+		if t.suppressor == nil || t.suppressor.heartbeat != t.HeartbeatIntervals {
+			t.suppressor = newSuppressor(t.HeartbeatIntervals)
+		}
+		sup = t.suppressor
+	}
+	if l := t.limiter; l != nil {
+		next := fn
+		fn = func(p *point) {
+			if !l.allow(pointSize(p)) {
+				stats.shed++
+				if sup != nil {
+					// Not sent, so not to be suppressed next time.
+					sup.forget(p)
+				}
+				return
+			}
+			next(p)
+		}
+	}
+	if sup != nil {
+		next := fn
+		fn = func(p *point) {
+			if sup.skip(p) {
+				stats.suppressed++
+				return
+			}
+			next(p)
+		}
+	}
+	if v := t.Validation; v != nil && v.Policy != NoValidation {
+		fn = rewritePoints(fn, func(name string, tags Tags) (string, Tags, bool) {
+			name, tags, corrected, ok := v.validate(name, tags)
+			if !ok {
+				stats.invalid++
+			} else if corrected {
+				stats.sanitized++
+			}
+			return name, tags, ok
+		})
+	}
+	if tags := t.Tags; len(tags) > 0 {
+		fn = rewritePoints(fn, func(name string, pt Tags) (string, Tags, bool) {
+			return name, pt.AddTags(tags), true
+		})
+	}
+	for i := len(t.Pipeline.Transformers) - 1; i >= 0; i-- {
+		fn = rewritePoints(fn, t.Pipeline.Transformers[i].Transform)
+	}
+	if f := t.Filter; f != nil {
+		next := fn
+		fn = func(p *point) {
+			if f.Match(p.Metric(), p.tags) {
+				next(p)
+			}
+		}
+	}
+	if r := t.Relabeling; r != nil {
+		fn = rewritePoints(fn, r.Relabel)
+	}
+	return fn
+}
+
+// rewritePoints calls next with the points renamed and retagged by rewrite,
+// dropping those it refuses. Walkers keep their point, so a copy is rewritten.
+func rewritePoints(next func(*point), rewrite func(string, Tags) (string, Tags, bool)) func(*point) {
+	var out point
+	return func(p *point) {
+		metric := p.Metric()
+		name, tags, ok := rewrite(metric, p.tags)
+		if !ok {
+			return
+		}
+		if name == metric && sameTags(tags, p.tags) {
+			next(p)
+			return
+		}
+		out = *p
+		out.name, out.suffix = name, ""
+		if !sameTags(tags, p.tags) {
+			out.tags, out.tagsID = tags, tags.TagsID()
+		}
+		next(&out)
+	}
+}
+
+// eachDue calls fn for every metric of the registry exported by the current
+// flush, once aggregated, by order of RateLimit priority when there is one.
+func (t *TaggedOpenTSDB) eachDue(fn func(string, TaggedMetric)) {
+	each := func(fn func(string, TaggedMetric)) {
+		t.Registry.Each(func(name string, tm TaggedMetric) {
+			if t.isDue(tm) {
+				fn(name, tm)
+			}
+		})
+	}
+	if t.Aggregation != nil {
+		each = t.Aggregation.aggregate(each, t.Logger)
+	}
+
+	l := t.RateLimit
+	if l == nil || len(l.Priorities) == 0 {
+		each(fn)
+		return
+	}
+
+	type namedMetric struct {
+		name string
+		tm   TaggedMetric
+	}
+	ranked := make([][]namedMetric, len(l.Priorities)+1)
+	each(func(name string, tm TaggedMetric) {
+		i := l.priority(name)
+		ranked[i] = append(ranked[i], namedMetric{name, tm})
+	})
+	for _, group := range ranked {
+		for _, m := range group {
+			fn(m.name, m.tm)
+		}
+	}
+}
+
+// durationUnit returns the unit durations are exported in.
+func (t *TaggedOpenTSDB) durationUnit() time.Duration {
+	if t.DurationUnit <= 0 {
+		return time.Millisecond
+	}
+	return t.DurationUnit
+}
+
+// eachTcollectorPoint walks the registry and calls fn for every point of the
+// Tcollector format.
+func (t *TaggedOpenTSDB) eachTcollectorPoint(now int64, fn func(*point)) {
+	fn = t.process(fn)
+	du := float64(t.durationUnit())
+	var p point
+	t.eachDue(func(name string, tm TaggedMetric) {
+		p = point{name: name, tags: tm.GetTags(), tagsID: tm.GetTagsID(), timestamp: now}
+		tcollectorPoints(&p, tm.GetMetric(), du, fn)
+	})
+}
+
+func tcollectorPoints(p *point, i interface{}, du float64, fn func(*point)) {
+	switch metric := i.(type) {
+	case metrics.Counter:
+		p.emitInt(fn, "", metric.Count())
+	case metrics.Gauge:
+		p.emitInt(fn, "", metric.Value())
+	case metrics.GaugeFloat64:
+		p.emitFloatPrec(fn, "", metric.Value(), 6)
+	case metrics.Histogram:
+		h := metric.Snapshot()
+		ps := h.Percentiles(exportedPercentiles)
+		p.emitInt(fn, ".count", h.Count())
+		p.emitInt(fn, ".min", h.Min())
+		p.emitInt(fn, ".max", h.Max())
+		p.emitFloat(fn, ".mean", h.Mean())
+		p.emitFloat(fn, ".std-dev", h.StdDev())
+		p.emitFloat(fn, ".p50", ps[0])
+		p.emitFloat(fn, ".p75", ps[1])
+		p.emitFloat(fn, ".p90", ps[2])
+		p.emitFloat(fn, ".p95", ps[3])
+		p.emitFloat(fn, ".p99", ps[4])
+	case *timerRates:
+		p.emitInt(fn, ".count", metric.Count())
+		p.emitFloat(fn, ".1m-rate", metric.Rate1())
+		p.emitFloat(fn, ".5m-rate", metric.Rate5())
+		p.emitFloat(fn, ".15m-rate", metric.Rate15())
+		p.emitFloat(fn, ".mean-rate", metric.RateMean())
+	case metrics.Meter:
+		m := metric.Snapshot()
+		p.emitInt(fn, "", m.Count())
+		p.emitFloat(fn, ".1m-rate", m.Rate1())
+		p.emitFloat(fn, ".5m-rate", m.Rate5())
+		p.emitFloat(fn, ".15m-rate", m.Rate15())
+		p.emitFloat(fn, ".mean-rate", m.RateMean())
+	case metrics.Timer:
+		t := metric.Snapshot()
+		ps := t.Percentiles(exportedPercentiles)
+		p.emitInt(fn, ".count", t.Count())
+		p.emitInt(fn, ".min", t.Min()/int64(du))
+		p.emitInt(fn, ".max", t.Max()/int64(du))
+		p.emitFloat(fn, ".mean", t.Mean()/du)
+		p.emitFloat(fn, ".std-dev", t.StdDev()/du)
+		p.emitFloat(fn, ".p50", ps[0]/du)
+		p.emitFloat(fn, ".p75", ps[1]/du)
+		p.emitFloat(fn, ".p90", ps[2]/du)
+		p.emitFloat(fn, ".p95", ps[3]/du)
+		p.emitFloat(fn, ".p99", ps[4]/du)
+		p.emitFloat(fn, ".1m-rate", t.Rate1())
+		p.emitFloat(fn, ".5m-rate", t.Rate5())
+		p.emitFloat(fn, ".15m-rate", t.Rate15())
+		p.emitFloat(fn, ".mean-rate", t.RateMean())
+	}
+}
+
+// eachJSONPoint walks the registry and calls fn for every point of the Json
+// format.
+func (t *TaggedOpenTSDB) eachJSONPoint(now int64, fn func(*point)) {
+	fn = t.process(fn)
+	var p point
+	t.eachDue(func(name string, tm TaggedMetric) {
+		p = point{name: name, tags: tm.GetTags(), tagsID: tm.GetTagsID(), timestamp: now}
+		jsonPoints(&p, tm.GetMetric(), fn)
+	})
+}
+
+func jsonPoints(p *point, i interface{}, fn func(*point)) {
+	switch metric := i.(type) {
+	case metrics.Counter:
+		p.emitInt(fn, "", metric.Count())
+	case metrics.Gauge:
+		p.emitInt(fn, "", metric.Value())
+	case metrics.GaugeFloat64:
+		p.emitFloat(fn, "", metric.Value())
+	case metrics.Histogram:
+		h := metric.Snapshot()
+		ps := h.Percentiles(exportedPercentiles)
+		p.emitInt(fn, ".count", h.Count())
+		p.emitInt(fn, ".min", h.Min())
+		p.emitInt(fn, ".max", h.Max())
+		p.emitFloat(fn, ".mean", h.Mean())
+		p.emitFloat(fn, ".std-dev", h.StdDev())
+		p.emitFloat(fn, ".p50", ps[0])
+		p.emitFloat(fn, ".p75", ps[1])
+		p.emitFloat(fn, ".p95", ps[2])
+		p.emitFloat(fn, ".p99", ps[3])
+		p.emitFloat(fn, ".p999", ps[4])
+	case *timerRates:
+		p.emitInt(fn, ".count", metric.Count())
+		p.emitFloat(fn, ".1m", metric.Rate1())
+		p.emitFloat(fn, ".5m", metric.Rate5())
+		p.emitFloat(fn, ".15m", metric.Rate15())
+		p.emitFloat(fn, ".mean-rate", metric.RateMean())
+	case metrics.Meter:
+		m := metric.Snapshot()
+		p.emitInt(fn, "", m.Count())
+		p.emitFloat(fn, ".1m", m.Rate1())
+		p.emitFloat(fn, ".5m", m.Rate5())
+		p.emitFloat(fn, ".15m", m.Rate15())
+		p.emitFloat(fn, ".mean-rate", m.RateMean())
+	case metrics.Timer:
+		t := metric.Snapshot()
+		ps := t.Percentiles(exportedPercentiles)
+		p.emitInt(fn, ".count", t.Count())
+		p.emitInt(fn, ".min", t.Min())
+		p.emitInt(fn, ".max", t.Max())
+		p.emitFloat(fn, ".mean", t.Mean())
+		p.emitFloat(fn, ".std-dev", t.StdDev())
+		p.emitFloat(fn, ".p50", ps[0])
+		p.emitFloat(fn, ".p75", ps[1])
+		p.emitFloat(fn, ".p95", ps[2])
+		p.emitFloat(fn, ".p99", ps[3])
+		p.emitFloat(fn, ".p999", ps[4])
+		p.emitFloat(fn, ".1m", t.Rate1())
+		p.emitFloat(fn, ".5m", t.Rate5())
+		p.emitFloat(fn, ".15m", t.Rate15())
+		p.emitFloat(fn, ".mean-rate", t.RateMean())
+	case IntegerHistogram:
+		h := metric.Snapshot()
+		ps := h.Percentiles(exportedPercentiles)
+		p.emitInt(fn, ".count", h.Count())
+		p.emitInt(fn, ".min", h.Min())
+		p.emitInt(fn, ".max", h.Max())
+		p.emitInt(fn, ".mean", h.Mean())
+		p.emitInt(fn, ".std-dev", h.StdDev())
+		p.emitInt(fn, ".p50", ps[0])
+		p.emitInt(fn, ".p75", ps[1])
+		p.emitInt(fn, ".p95", ps[2])
+		p.emitInt(fn, ".p99", ps[3])
+		p.emitInt(fn, ".p999", ps[4])
+	}
+}
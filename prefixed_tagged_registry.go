@@ -60,6 +60,12 @@ func (r *PrefixedTaggedRegistry) Add(name string, tags Tags, i interface{}) erro
 	return r.underlying.Add(name, tags, i)
 }
 
+// Pending returns the number of metrics added with Add() which have not been
+// reported yet.
+func (r *PrefixedTaggedRegistry) Pending() int {
+	return pending(r.underlying)
+}
+
 // Run all registered healthchecks.
 func (r *PrefixedTaggedRegistry) RunHealthchecks() {
 	r.underlying.RunHealthchecks()
@@ -0,0 +1,147 @@
+package tsdmetrics
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+)
+
+// RateLimit bounds the points and bytes sent per second with token buckets.
+// Points are sent in the order of Priorities, so that when the budget runs
+// out, the points of the least important metrics are the ones delayed or shed.
+type RateLimit struct {
+	PointsPerSecond float64       // 0 for no limit
+	BytesPerSecond  float64       // Serialized size in the Tcollector format before compression, 0 for no limit
+	Burst           time.Duration // Budget saved up at most between flushes, FlushInterval when 0, at least one point
+	Shed            bool          // Drop the points over the budget instead of waiting for it
+	Priorities      []string      // Metric name prefixes, most important first, the others last
+}
+
+// rateLimiter enforces a RateLimit across flushes.
+type rateLimiter struct {
+	config *RateLimit
+	clock  Clock
+	points tokenBucket
+	bytes  tokenBucket
+	ctx    context.Context // Context of the current flush, which bounds delays
+	until  time.Time       // End of the current flush, zero when unbounded
+	shed   bool            // The current flush ran out of time, shed the rest
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (t *TaggedOpenTSDB) newRateLimiter(l *RateLimit) *rateLimiter {
+	burst := l.Burst
+	if burst <= 0 {
+		burst = t.FlushInterval
+	}
+	if burst < time.Second {
+		burst = time.Second
+	}
+	now := t.clock().Now()
+	newBucket := func(rate float64) tokenBucket {
+		// Under one token, the bucket would never hold enough for a point.
+		b := math.Max(rate*burst.Seconds(), 1)
+		return tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+	}
+	return &rateLimiter{
+		config: l,
+		clock:  t.clock(),
+		points: newBucket(l.PointsPerSecond),
+		bytes:  newBucket(l.BytesPerSecond),
+	}
+}
+
+// refill adds the tokens earned since the last refill.
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate <= 0 {
+		return
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// wait returns how long to wait for n tokens, 0 when they are available. A
+// full bucket is enough for more than its burst, which is then borrowed from
+// the next refills.
+func (b *tokenBucket) wait(n float64) time.Duration {
+	n = math.Min(n, b.burst)
+	if b.rate <= 0 || b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
+
+// allow tells if a point of size bytes may be sent, waiting for the budget
+// unless shedding. Waits never go past the end of the flush, the points which
+// would need it are shed along with the rest of the flush.
+func (l *rateLimiter) allow(size int) bool {
+	for !l.shed {
+		now := l.clock.Now()
+		l.points.refill(now)
+		l.bytes.refill(now)
+
+		wait := l.points.wait(1)
+		if w := l.bytes.wait(float64(size)); w > wait {
+			wait = w
+		}
+		if wait == 0 {
+			l.points.take(1)
+			l.bytes.take(float64(size))
+			return true
+		}
+		if l.config.Shed {
+			return false
+		}
+		if !l.until.IsZero() && now.Add(wait).After(l.until) {
+			l.shed = true
+			break
+		}
+
+		timer := l.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-l.ctx.Done():
+			timer.Stop()
+			l.shed = true
+		}
+	}
+	return false
+}
+
+// priority returns the rank of the metric name in Priorities, 0 being the
+// most important.
+func (l *RateLimit) priority(name string) int {
+	for i, prefix := range l.Priorities {
+		if strings.HasPrefix(name, prefix) {
+			return i
+		}
+	}
+	return len(l.Priorities)
+}
+
+// pointSize estimates the size of p in the Tcollector format.
+func pointSize(p *point) int {
+	n := len("put ") + len(p.name) + len(p.suffix) + len(" 1505484300 ") + 8 + 1
+	for k, v := range p.tags {
+		n += len(k) + len(v) + 2
+	}
+	return n
+}
@@ -0,0 +1,163 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRateLimitShed(t *testing.T) {
+	r := NewTaggedRegistry()
+	for _, name := range []string{"debug.a", "debug.b", "app.a", "app.b", "other"} {
+		r.Register(name, Tags{"host": "a"}, metrics.NewCounter())
+	}
+
+	var buf bytes.Buffer
+	var result FlushResult
+	clock := NewFakeClock(time.Unix(1505484300, 0))
+	e := &TaggedOpenTSDB{
+		Writer:        &buf,
+		Registry:      r,
+		FlushInterval: 10 * time.Second,
+		RateLimit:     &RateLimit{PointsPerSecond: 0.3, Shed: true, Priorities: []string{"app.", "other"}},
+		OnFlush:       func(r FlushResult) { result = r },
+		Logger:        log.New(),
+		Clock:         clock,
+	}
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "put app.a 1505484300 0 host=a \nput app.b 1505484300 0 host=a \nput other 1505484300 0 host=a \n"
+	if got := sortLines(buf.String()); got != expected {
+		t.Errorf("Expected the most important points, got:\n%s", got)
+	}
+	if result.Shed != 2 {
+		t.Errorf("Expected 2 points shed, got %d", result.Shed)
+	}
+
+	// 3 points earned in 10s.
+	buf.Reset()
+	clock.Advance(e.FlushInterval)
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if result.Points != 3 || result.Shed != 2 {
+		t.Errorf("Expected 3 points sent and 2 shed, got %+v", result)
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	r := NewTaggedRegistry()
+	r.Register("a", Tags{"host": "a"}, metrics.NewCounter())
+	r.Register("b", Tags{"host": "a"}, metrics.NewCounter())
+
+	var buf bytes.Buffer
+	clock := NewFakeClock(time.Unix(1505484300, 0))
+	e := &TaggedOpenTSDB{
+		Writer:        &buf,
+		Registry:      r,
+		FlushInterval: time.Second,
+		RateLimit:     &RateLimit{PointsPerSecond: 1},
+		Logger:        log.New(),
+		Clock:         clock,
+	}
+
+	done := make(chan error)
+	go func() { done <- e.Export() }()
+	clock.BlockUntil(1)
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 0 {
+		t.Fatalf("Expected the flush to wait for its budget, got %d points", n)
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 2 {
+		t.Errorf("Expected 2 points once delayed, got %d", n)
+	}
+}
+
+func TestRateLimitShedUnchanged(t *testing.T) {
+	r := NewTaggedRegistry()
+	for _, name := range []string{"a", "b", "c"} {
+		r.Register(name, Tags{"host": "a"}, metrics.NewCounter())
+	}
+
+	var buf bytes.Buffer
+	clock := NewFakeClock(time.Unix(1505484300, 0))
+	e := &TaggedOpenTSDB{
+		Writer:            &buf,
+		Registry:          r,
+		FlushInterval:     time.Second,
+		RateLimit:         &RateLimit{PointsPerSecond: 1, Shed: true},
+		SuppressUnchanged: true,
+		Logger:            log.New(),
+		Clock:             clock,
+	}
+	for i := 0; i < 3; i++ {
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(e.FlushInterval)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if !bytes.Contains(buf.Bytes(), []byte("put "+name+" ")) {
+			t.Errorf("Expected the shed series %s to be sent by a later flush, got:\n%s", name, buf.String())
+		}
+	}
+}
+
+func TestRateLimitDelayBoundedByFlush(t *testing.T) {
+	r := NewTaggedRegistry()
+	for _, name := range []string{"a", "b", "c"} {
+		r.Register(name, Tags{"host": "a"}, metrics.NewCounter())
+	}
+
+	var buf bytes.Buffer
+	var result FlushResult
+	clock := NewFakeClock(time.Unix(1505484300, 0))
+	e := &TaggedOpenTSDB{
+		Writer:        &buf,
+		Registry:      r,
+		FlushInterval: time.Second,
+		RateLimit:     &RateLimit{PointsPerSecond: 1},
+		OnFlush:       func(r FlushResult) { result = r },
+		Logger:        log.New(),
+		Clock:         clock,
+	}
+
+	done := make(chan error)
+	go func() { done <- e.Export() }()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if result.Points != 2 || result.Shed != 1 {
+		t.Errorf("Expected the point past the end of the flush to be shed, got %+v", result)
+	}
+}
+
+func TestRateLimitUnderOnePointPerSecond(t *testing.T) {
+	r := NewTaggedRegistry()
+	r.Register("a", Tags{"host": "a"}, metrics.NewCounter())
+
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{
+		Writer:        &buf,
+		Registry:      r,
+		FlushInterval: time.Second,
+		RateLimit:     &RateLimit{PointsPerSecond: 0.5, Shed: true},
+		Logger:        log.New(),
+		Clock:         NewFakeClock(time.Unix(1505484300, 0)),
+	}
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() == 0 {
+		t.Error("Expected a burst of at least one point")
+	}
+}
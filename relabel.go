@@ -0,0 +1,197 @@
+package tsdmetrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// MetricNameTag refers to the full metric name in the source and target tags
+// of relabel rules.
+const MetricNameTag = "__name__"
+
+// RelabelAction is what a RelabelRule does to the series it applies to.
+type RelabelAction string
+
+const (
+	RelabelReplace RelabelAction = "replace" // Set Target to the expanded Replacement when Regex matches
+	RelabelKeep    RelabelAction = "keep"    // Drop the series unless Regex matches
+	RelabelDrop    RelabelAction = "drop"    // Drop the series when Regex matches
+	RelabelTagDrop RelabelAction = "tagdrop" // Remove the tags whose key matches Regex
+	RelabelTagKeep RelabelAction = "tagkeep" // Remove the tags whose key does not match Regex
+)
+
+// RelabelRule rewrites exported series, like the relabel_configs of
+// Prometheus. The values of SourceTags are joined with Separator and matched
+// against Regex, which is anchored on both ends.
+//
+// Renaming a metric replaces MetricNameTag, tags are added by replacing them
+// and removed by replacing them with an empty value.
+type RelabelRule struct {
+	SourceTags  []string      `yaml:"source_tags" json:"source_tags"`
+	Separator   string        `yaml:"separator" json:"separator"`     // ";" when empty
+	Regex       string        `yaml:"regex" json:"regex"`             // "(.*)" when empty
+	Target      string        `yaml:"target" json:"target"`           // Tag set by replace, MetricNameTag for the name
+	Replacement string        `yaml:"replacement" json:"replacement"` // "$1" when empty, may refer to Regex groups
+	Action      RelabelAction `yaml:"action" json:"action"`           // RelabelReplace when empty
+
+	re *regexp.Regexp
+}
+
+// Relabeling is an ordered list of rules, each one seeing the result of the
+// previous ones. It must not be modified once given to an exporter.
+type Relabeling struct {
+	Rules []RelabelRule `yaml:"rules" json:"rules"`
+
+	compiled bool
+}
+
+// ParseRelabeling reads a Relabeling from YAML, either a list of rules or a
+// mapping with a rules key.
+func ParseRelabeling(b []byte) (*Relabeling, error) {
+	r := &Relabeling{}
+	if err := yaml.UnmarshalStrict(b, &r.Rules); err != nil {
+		if err2 := yaml.UnmarshalStrict(b, r); err2 != nil {
+			return nil, fmt.Errorf("Invalid relabeling: %s", err)
+		}
+	}
+	if err := r.Compile(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Compile checks the rules and fills in their defaults. Exporters compile
+// their relabeling on first use, calling it beforehand reports configuration
+// errors early.
+func (r *Relabeling) Compile() error {
+	if r.compiled {
+		return nil
+	}
+	for i := range r.Rules {
+		if err := r.Rules[i].compile(); err != nil {
+			return fmt.Errorf("Relabel rule %d: %s", i, err)
+		}
+	}
+	r.compiled = true
+	return nil
+}
+
+func (rule *RelabelRule) compile() error {
+	if rule.Action == "" {
+		rule.Action = RelabelReplace
+	}
+	if rule.Separator == "" {
+		rule.Separator = ";"
+	}
+	if rule.Regex == "" {
+		rule.Regex = "(.*)"
+	}
+	if rule.Replacement == "" {
+		rule.Replacement = "$1"
+	}
+
+	switch rule.Action {
+	case RelabelReplace:
+		if rule.Target == "" {
+			return fmt.Errorf("replace needs a target")
+		}
+	case RelabelKeep, RelabelDrop, RelabelTagDrop, RelabelTagKeep:
+	default:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	re, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+	if err != nil {
+		return err
+	}
+	rule.re = re
+	return nil
+}
+
+// Relabel applies the rules to a series and returns its new name and tags,
+// or false when it is dropped. tags is not modified.
+func (r *Relabeling) Relabel(name string, tags Tags) (string, Tags, bool) {
+	copied := false
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		switch rule.Action {
+		case RelabelReplace:
+			src := rule.source(name, tags)
+			m := rule.re.FindStringSubmatchIndex(src)
+			if m == nil {
+				continue
+			}
+			v := string(rule.re.ExpandString(nil, rule.Replacement, src, m))
+			if rule.Target == MetricNameTag {
+				if v != "" {
+					name = v
+				}
+				continue
+			}
+			if !copied {
+				tags, copied = copyTags(tags), true
+			}
+			if v == "" {
+				delete(tags, rule.Target)
+			} else {
+				tags[rule.Target] = v
+			}
+		case RelabelKeep:
+			if !rule.re.MatchString(rule.source(name, tags)) {
+				return name, tags, false
+			}
+		case RelabelDrop:
+			if rule.re.MatchString(rule.source(name, tags)) {
+				return name, tags, false
+			}
+		case RelabelTagDrop, RelabelTagKeep:
+			for k := range tags {
+				if rule.re.MatchString(k) != (rule.Action == RelabelTagKeep) {
+					if !copied {
+						tags, copied = copyTags(tags), true
+					}
+					delete(tags, k)
+				}
+			}
+		}
+	}
+	return name, tags, true
+}
+
+func (rule *RelabelRule) source(name string, tags Tags) string {
+	if len(rule.SourceTags) == 1 {
+		return rule.value(rule.SourceTags[0], name, tags)
+	}
+	values := make([]string, len(rule.SourceTags))
+	for i, k := range rule.SourceTags {
+		values[i] = rule.value(k, name, tags)
+	}
+	return strings.Join(values, rule.Separator)
+}
+
+func (rule *RelabelRule) value(key, name string, tags Tags) string {
+	if key == MetricNameTag {
+		return name
+	}
+	return tags[key]
+}
+
+func copyTags(tags Tags) Tags {
+	c := make(Tags, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+func sameTags(a, b Tags) bool {
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
@@ -0,0 +1,81 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const testRelabeling = `
+- source_tags: [__name__]
+  regex: 'old\.(.*)'
+  target: __name__
+  replacement: 'new.$1'
+- source_tags: [__name__]
+  regex: 'new\.([^.]+)\..*'
+  target: service
+- source_tags: [__name__, dc]
+  separator: '.'
+  regex: '(.*)\.count\.(.+)'
+  target: __name__
+  replacement: '$1.$2.count'
+- target: env
+  replacement: prod
+- action: tagdrop
+  regex: 'dc'
+- source_tags: [__name__]
+  regex: '.*\.std-dev'
+  action: drop
+`
+
+func TestRelabeling(t *testing.T) {
+	rl, err := ParseRelabeling([]byte(testRelabeling))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewTaggedRegistry()
+	r.Register("old.api.requests", Tags{"host": "a", "dc": "x"}, metrics.NewCounter())
+	r.Register("old.api.latency", Tags{"host": "a", "dc": "x"}, metrics.NewHistogram(metrics.NewUniformSample(10)))
+
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{
+		Writer:     &buf,
+		Registry:   r,
+		Format:     Tcollector,
+		Relabeling: rl,
+		Filter:     &SeriesFilter{Allow: []SeriesMatcher{{Name: "*.requests"}, {Name: "*.count"}}},
+		Logger:     log.New(),
+		Clock:      NewFakeClock(time.Unix(1505484300, 0)),
+	}
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "put new.api.latency.x.count 1505484300 0 env=prod host=a service=api \n" +
+		"put new.api.requests 1505484300 0 env=prod host=a service=api \n"
+	if got := sortLines(buf.String()); got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+	if _, _, ok := rl.Relabel("new.api.latency.std-dev", Tags{}); ok {
+		t.Error("Expected std-dev series to be dropped")
+	}
+
+	if _, err := ParseRelabeling([]byte("- action: replace\n")); err == nil {
+		t.Error("Expected replace without target to be refused")
+	}
+	if _, err := ParseRelabeling([]byte("rules:\n- action: keep\n  source_tags: [host]\n")); err != nil {
+		t.Error(err)
+	}
+}
+
+func sortLines(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "")
+}
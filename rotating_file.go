@@ -0,0 +1,152 @@
+package tsdmetrics
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an io.WriteCloser appending to a file which is rotated
+// when it grows over MaxSize bytes or when MaxAge passed since it was first
+// written to. Rotated files are renamed with the time of their rotation
+// appended to their path. When the rename fails, writing goes on in the
+// original file and rotation is attempted again at the next line.
+//
+// Rotation only happens at line boundaries, so a file written with the
+// JsonLines or Tcollector formats always holds complete lines and can be
+// shipped to OpenTSDB as soon as it is rotated.
+type RotatingFile struct {
+	Path    string
+	MaxSize int64         // 0 for no size limit
+	MaxAge  time.Duration // 0 for no age limit
+	Clock   Clock         // Time source for MaxAge and the rotated names, RealClock when nil
+
+	mutex    sync.Mutex
+	file     *os.File
+	w        *bufio.Writer
+	size     int64
+	started  time.Time // First write to the file, zero before
+	lastByte byte
+}
+
+// NewRotatingFile opens path for appending, creating it if needed.
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize, MaxAge: maxAge}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.w = bufio.NewWriter(file)
+	f.size = info.Size()
+	f.started = time.Time{}
+	f.lastByte = '\n'
+	return nil
+}
+
+func (f *RotatingFile) clock() Clock {
+	if f.Clock == nil {
+		return RealClock{}
+	}
+	return f.Clock
+}
+
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.lastByte == '\n' && f.size > 0 && f.due() {
+		// A file which could not be rotated is still written to.
+		if err := f.rotate(); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+	if f.started.IsZero() {
+		f.started = f.clock().Now()
+	}
+
+	n, err := f.w.Write(b)
+	f.size += int64(n)
+	if n > 0 {
+		f.lastByte = b[n-1]
+	}
+	return n, err
+}
+
+func (f *RotatingFile) due() bool {
+	return (f.MaxSize > 0 && f.size >= f.MaxSize) || (f.MaxAge > 0 && !f.started.IsZero() && f.clock().Now().Sub(f.started) >= f.MaxAge)
+}
+
+// Rotate closes the current file, renames it and opens a new one.
+func (f *RotatingFile) Rotate() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.rotate()
+}
+
+// rotate renames the current file and opens a new one, or reopens the
+// current one when it cannot be renamed so that writing can go on.
+func (f *RotatingFile) rotate() error {
+	started := f.started
+	err := f.close()
+	if err == nil {
+		rotated := fmt.Sprintf("%s.%s", f.Path, f.clock().Now().UTC().Format("20060102T150405.000000000"))
+		err = os.Rename(f.Path, rotated)
+	}
+	if oerr := f.open(); oerr != nil {
+		return oerr
+	}
+	if err != nil {
+		f.started = started
+	}
+	return err
+}
+
+// Flush writes buffered data to the current file.
+func (f *RotatingFile) Flush() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.w.Flush()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.close()
+}
+
+func (f *RotatingFile) close() error {
+	err := f.w.Flush()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	f.file = nil
+	return err
+}
@@ -0,0 +1,98 @@
+package tsdmetrics
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// SampledTimer is a metrics.Timer which exposes its sample, so that the
+// exporter can merge timers when aggregating series. Timers from
+// metrics.NewTimer keep their sample private, only their counts and rates can
+// be aggregated.
+type SampledTimer struct {
+	histogram metrics.Histogram
+	meter     metrics.Meter
+}
+
+// NewSampledTimer returns a SampledTimer recording durations in s.
+func NewSampledTimer(s metrics.Sample) *SampledTimer {
+	return &SampledTimer{histogram: metrics.NewHistogram(s), meter: metrics.NewMeter()}
+}
+
+// Sample returns the sample of the recorded durations.
+func (t *SampledTimer) Sample() metrics.Sample { return t.histogram.Sample() }
+
+func (t *SampledTimer) Count() int64                       { return t.histogram.Count() }
+func (t *SampledTimer) Max() int64                         { return t.histogram.Max() }
+func (t *SampledTimer) Mean() float64                      { return t.histogram.Mean() }
+func (t *SampledTimer) Min() int64                         { return t.histogram.Min() }
+func (t *SampledTimer) Percentile(p float64) float64       { return t.histogram.Percentile(p) }
+func (t *SampledTimer) Percentiles(ps []float64) []float64 { return t.histogram.Percentiles(ps) }
+func (t *SampledTimer) Rate1() float64                     { return t.meter.Rate1() }
+func (t *SampledTimer) Rate5() float64                     { return t.meter.Rate5() }
+func (t *SampledTimer) Rate15() float64                    { return t.meter.Rate15() }
+func (t *SampledTimer) RateMean() float64                  { return t.meter.RateMean() }
+func (t *SampledTimer) StdDev() float64                    { return t.histogram.StdDev() }
+func (t *SampledTimer) Sum() int64                         { return t.histogram.Sum() }
+func (t *SampledTimer) Variance() float64                  { return t.histogram.Variance() }
+
+// Snapshot returns a read-only copy of the timer.
+func (t *SampledTimer) Snapshot() metrics.Timer {
+	return &SampledTimer{histogram: t.histogram.Snapshot(), meter: t.meter.Snapshot()}
+}
+
+// Stop stops the meter of the timer.
+func (t *SampledTimer) Stop() {
+	if s, ok := t.meter.(interface {
+		Stop()
+	}); ok {
+		s.Stop()
+	}
+}
+
+// Time records the duration of the execution of f.
+func (t *SampledTimer) Time(f func()) {
+	start := time.Now()
+	f()
+	t.UpdateSince(start)
+}
+
+// Update records the duration of an event.
+func (t *SampledTimer) Update(d time.Duration) {
+	t.histogram.Update(int64(d))
+	t.meter.Mark(1)
+}
+
+// UpdateSince records the duration of an event that started at ts.
+func (t *SampledTimer) UpdateSince(ts time.Time) {
+	t.Update(time.Since(ts))
+}
+
+// timerRates is the result of merging timers without their samples, exported
+// as the counts and rates of a timer.
+type timerRates struct {
+	meterRates
+}
+
+// meterRates is a read-only metrics.Meter made of merged rates.
+type meterRates struct {
+	count                          int64
+	rate1, rate5, rate15, rateMean float64
+}
+
+func (m *meterRates) Count() int64            { return m.count }
+func (m *meterRates) Mark(int64)              { panic("Mark called on merged rates") }
+func (m *meterRates) Rate1() float64          { return m.rate1 }
+func (m *meterRates) Rate5() float64          { return m.rate5 }
+func (m *meterRates) Rate15() float64         { return m.rate15 }
+func (m *meterRates) RateMean() float64       { return m.rateMean }
+func (m *meterRates) Snapshot() metrics.Meter { return m }
+func (m *meterRates) Stop()                   {}
+func (m *meterRates) add(count int64, r1, r5, r15, mean float64) {
+	m.count += count
+	m.rate1 += r1
+	m.rate5 += r5
+	m.rate15 += r15
+	m.rateMean += mean
+}
@@ -1,11 +1,16 @@
 package tsdmetrics
 
-import "fmt"
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
 
 type SegmentedTaggedRegistry struct {
 	parent      TaggedRegistry
 	prefix      string
 	defaultTags Tags
+	interval    int64 // time.Duration, accessed atomically
 }
 
 func NewRootSegmentedTaggedRegistry(tags Tags) TaggedRegistry {
@@ -65,6 +70,31 @@ func (r *SegmentedTaggedRegistry) GetPrefix() string {
 	return n
 }
 
+// SetExportInterval sets the export interval of the metrics registered in
+// this segment and its children from now on. An interval of 0 inherits the
+// parent's, or the exporter's FlushInterval at the root.
+func (r *SegmentedTaggedRegistry) SetExportInterval(d time.Duration) {
+	atomic.StoreInt64(&r.interval, int64(d))
+}
+
+// GetExportInterval returns the export interval of the metrics registered in
+// this segment, 0 meaning the exporter's FlushInterval.
+func (r *SegmentedTaggedRegistry) GetExportInterval() time.Duration {
+	if d := time.Duration(atomic.LoadInt64(&r.interval)); d > 0 {
+		return d
+	}
+	if s, ok := r.parent.(*SegmentedTaggedRegistry); ok {
+		return s.GetExportInterval()
+	}
+	return 0
+}
+
+// SetMetricExportInterval sets the export interval of a metric registered
+// in this segment.
+func (r *SegmentedTaggedRegistry) SetMetricExportInterval(name string, tags Tags, d time.Duration) error {
+	return setMetricExportInterval(r.GetRootRegistry(), r.GetName(name), r.GetTags(tags), d)
+}
+
 func (r *SegmentedTaggedRegistry) GetTags(t Tags) Tags {
 	tags := t
 	if s, ok := r.parent.(*SegmentedTaggedRegistry); ok {
@@ -74,6 +104,15 @@ func (r *SegmentedTaggedRegistry) GetTags(t Tags) Tags {
 	return tags.AddTags(r.defaultTags)
 }
 
+// SetCardinalityLimits applies limits to the registrations to come in the
+// root registry, which are shared by all the segments. Its counters are
+// registered in this segment, with its prefix and default tags.
+func (r *SegmentedTaggedRegistry) SetCardinalityLimits(limits CardinalityLimits) {
+	if root, ok := r.GetRootRegistry().(*DefaultTaggedRegistry); ok {
+		root.setCardinalityLimits(limits, r.GetName(""), r.GetTags(DefaultSelfMetricsTags))
+	}
+}
+
 // Call the given function for each registered metric.
 func (r *SegmentedTaggedRegistry) Each(fn func(string, TaggedMetric)) {
 	wrapperFn := func(n string, m TaggedMetric) (string, TaggedMetric) {
@@ -95,19 +134,46 @@ func (r *SegmentedTaggedRegistry) Get(name string, tags Tags) interface{} {
 // Gets an existing metric or registers the given one.
 // The interface can be the metric to register if not found in registry,
 // or a function returning the metric for lazy instantiation.
+// New metrics are exported at the interval of the segment.
 func (r *SegmentedTaggedRegistry) GetOrRegister(name string, tags Tags, i interface{}) interface{} {
-	return r.GetRootRegistry().GetOrRegister(r.GetName(name), r.GetTags(tags), i)
+	root := r.GetRootRegistry()
+	if d, ok := root.(*DefaultTaggedRegistry); ok {
+		return d.getOrRegister(r.GetName(name), r.GetTags(tags), i, r.GetExportInterval())
+	}
+	return root.GetOrRegister(r.GetName(name), r.GetTags(tags), i)
 }
 
 // Register the given metric under the given name. The name will be prefixed.
+// The metric is exported at the interval of the segment.
 func (r *SegmentedTaggedRegistry) Register(name string, tags Tags, i interface{}) error {
-	return r.GetRootRegistry().Register(r.GetName(name), r.GetTags(tags), i)
+	root := r.GetRootRegistry()
+	if d, ok := root.(*DefaultTaggedRegistry); ok {
+		return d.registerEvery(r.GetName(name), r.GetTags(tags), i, r.GetExportInterval())
+	}
+	return root.Register(r.GetName(name), r.GetTags(tags), i)
 }
 
 func (r *SegmentedTaggedRegistry) Add(name string, tags Tags, i interface{}) error {
 	return r.GetRootRegistry().Add(r.GetName(name), r.GetTags(tags), i)
 }
 
+// Pending returns the number of metrics added with Add() which have not been
+// reported yet.
+func (r *SegmentedTaggedRegistry) Pending() int {
+	return pending(r.GetRootRegistry())
+}
+
+// ExportIntervals returns the export intervals set on the metrics of the
+// root registry, when it tracks them.
+func (r *SegmentedTaggedRegistry) ExportIntervals() []time.Duration {
+	if root, ok := r.GetRootRegistry().(interface {
+		ExportIntervals() []time.Duration
+	}); ok {
+		return root.ExportIntervals()
+	}
+	return nil
+}
+
 // Run all registered healthchecks.
 func (r *SegmentedTaggedRegistry) RunHealthchecks() {
 	r.parent.RunHealthchecks()
@@ -0,0 +1,127 @@
+package tsdmetrics
+
+import (
+	"io"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// DefaultSelfMetricsTags identifies the exporter's own metrics so they can be
+// filtered out of dashboards.
+var DefaultSelfMetricsTags = Tags{"tsdmetrics": "self"}
+
+// flushStats accumulates the outcome of a single flush.
+type flushStats struct {
+	points      int64 // Points accepted by the server
+	bytes       int64 // Bytes sent on the wire
+	failedBulks int64 // Bulks which could not be delivered
+	rejected    int64 // Points refused by the server
+	sanitized   int64 // Points corrected by Validation
+	invalid     int64 // Points dropped by Validation
+	suppressed  int64 // Points skipped as unchanged
+	shed        int64 // Points dropped by RateLimit
+	annotations int64 // Annotations accepted by the server
+	queued      int   // One-shot metrics waiting for the flush
+}
+
+type exporterMetrics struct {
+	points        metrics.Counter
+	bytes         metrics.Counter
+	failedBulks   metrics.Counter
+	rejected      metrics.Counter
+	sanitized     metrics.Counter
+	invalid       metrics.Counter
+	suppressed    metrics.Counter
+	shed          metrics.Counter
+	flushDuration metrics.Timer
+	lastSuccess   metrics.Gauge
+	queueDepth    metrics.Gauge
+}
+
+// selfMetrics creates the exporter metrics on first use, and registers or
+// unregisters them whenever SelfMetrics changed since the previous flush.
+func (t *TaggedOpenTSDB) selfMetrics() *exporterMetrics {
+	t.selfMetricsOnce.Do(func() {
+		t.metrics = &exporterMetrics{
+			points:        metrics.NewCounter(),
+			bytes:         metrics.NewCounter(),
+			failedBulks:   metrics.NewCounter(),
+			rejected:      metrics.NewCounter(),
+			sanitized:     metrics.NewCounter(),
+			invalid:       metrics.NewCounter(),
+			suppressed:    metrics.NewCounter(),
+			shed:          metrics.NewCounter(),
+			flushDuration: metrics.NewTimer(),
+			lastSuccess:   metrics.NewGauge(),
+			queueDepth:    metrics.NewGauge(),
+		}
+	})
+
+	switch {
+	case t.SelfMetrics && t.selfRegistry == nil:
+		r := t.SelfMetricsRegistry
+		if r == nil {
+			r = t.Registry
+		}
+		tags := t.SelfMetricsTags
+		if tags == nil {
+			tags = DefaultSelfMetricsTags
+		}
+		t.selfRegistry = NewSegmentedTaggedRegistry("tsdmetrics.exporter", tags, r).(*SegmentedTaggedRegistry)
+		t.metrics.each(func(name string, m interface{}) {
+			t.selfRegistry.Register(name, Tags{}, m)
+		})
+	case !t.SelfMetrics && t.selfRegistry != nil:
+		// Unregister does not prefix the name, the root is told the full one.
+		r := t.selfRegistry
+		t.metrics.each(func(name string, m interface{}) {
+			r.GetRootRegistry().Unregister(r.GetName(name), r.GetTags(Tags{}))
+		})
+		t.selfRegistry = nil
+	}
+	return t.metrics
+}
+
+// each calls fn with the name of every metric in m.
+func (m *exporterMetrics) each(fn func(string, interface{})) {
+	fn("points", m.points)
+	fn("bytes", m.bytes)
+	fn("bulks.failed", m.failedBulks)
+	fn("points.rejected", m.rejected)
+	fn("points.sanitized", m.sanitized)
+	fn("points.invalid", m.invalid)
+	fn("points.suppressed", m.suppressed)
+	fn("points.shed", m.shed)
+	fn("flush.duration", m.flushDuration)
+	fn("flush.last-success", m.lastSuccess)
+	fn("queue.depth", m.queueDepth)
+}
+
+func (m *exporterMetrics) update(stats *flushStats, start time.Time, duration time.Duration) {
+	m.points.Inc(stats.points)
+	m.bytes.Inc(stats.bytes)
+	m.failedBulks.Inc(stats.failedBulks)
+	m.rejected.Inc(stats.rejected)
+	m.sanitized.Inc(stats.sanitized)
+	m.invalid.Inc(stats.invalid)
+	m.suppressed.Inc(stats.suppressed)
+	m.shed.Inc(stats.shed)
+	m.queueDepth.Update(int64(stats.queued))
+	m.flushDuration.Update(duration)
+	if stats.failedBulks == 0 {
+		m.lastSuccess.Update(start.Unix())
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,89 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	status := http.StatusNoContent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		if status == http.StatusBadRequest {
+			w.Write([]byte(`{"success":1,"failed":2}`))
+		}
+	}))
+	defer ts.Close()
+
+	r := NewTaggedRegistry()
+	r.Register("test", Tags{"host": "a"}, metrics.NewCounter())
+	r.Register("other", Tags{"host": "a"}, metrics.NewGauge())
+
+	self := NewTaggedRegistry()
+	e := &TaggedOpenTSDB{
+		Addr:                ts.URL,
+		Registry:            r,
+		FlushInterval:       time.Second,
+		Format:              Json,
+		SelfMetrics:         true,
+		SelfMetricsRegistry: self,
+		Logger:              log.New(),
+	}
+
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+	status = http.StatusBadRequest
+	r.Register("third", Tags{"host": "a"}, metrics.NewCounter())
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(name string) interface{} {
+		return self.Get("tsdmetrics.exporter."+name, DefaultSelfMetricsTags)
+	}
+	if c := get("points").(metrics.Counter).Count(); c != 3 {
+		t.Errorf("Expected 3 points exported, got %d", c)
+	}
+	if c := get("points.rejected").(metrics.Counter).Count(); c != 2 {
+		t.Errorf("Expected 2 points rejected, got %d", c)
+	}
+	if c := get("bulks.failed").(metrics.Counter).Count(); c != 0 {
+		t.Errorf("Expected no failed bulks, got %d", c)
+	}
+	if c := get("bytes").(metrics.Counter).Count(); c == 0 {
+		t.Error("Expected bytes to be counted")
+	}
+	if c := get("flush.duration").(metrics.Timer).Count(); c != 2 {
+		t.Errorf("Expected 2 flushes timed, got %d", c)
+	}
+	if v := get("flush.last-success").(metrics.Gauge).Value(); v == 0 {
+		t.Error("Expected the last successful flush to be recorded")
+	}
+}
+
+func TestSelfMetricsTcollectorDefaultDurationUnit(t *testing.T) {
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{
+		Writer:      &buf,
+		Registry:    NewTaggedRegistry(),
+		Format:      Tcollector,
+		SelfMetrics: true,
+		Logger:      log.New(),
+	}
+	for i := 0; i < 2; i++ {
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(buf.String(), "put tsdmetrics.exporter.flush.duration.max ") {
+		t.Errorf("Expected the flush duration in milliseconds, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,81 @@
+package tsdmetrics
+
+import "time"
+
+// suppressor skips the points whose value did not change since the last one
+// sent for their series, sending them anyway every heartbeat flushes.
+type suppressor struct {
+	heartbeat int
+	last      map[seriesKey]*lastPoint
+}
+
+type seriesKey struct {
+	name   string
+	suffix string
+	id     TagsID
+}
+
+type lastPoint struct {
+	isFloat bool
+	ival    int64
+	fval    float64
+	skipped int   // Flushes skipped since the value was last sent
+	seen    int64 // Timestamp of the last flush exporting the series
+}
+
+func newSuppressor(heartbeat int) *suppressor {
+	return &suppressor{heartbeat: heartbeat, last: make(map[seriesKey]*lastPoint)}
+}
+
+// skip tells if p is unchanged and must not be sent.
+func (s *suppressor) skip(p *point) bool {
+	k := seriesKey{p.name, p.suffix, p.tagsID}
+	l, ok := s.last[k]
+	if !ok {
+		l = &lastPoint{}
+		s.last[k] = l
+	}
+	l.seen = p.timestamp
+
+	if ok && l.isFloat == p.isFloat && l.ival == p.ival && l.fval == p.fval {
+		l.skipped++
+		if s.heartbeat <= 0 || l.skipped < s.heartbeat {
+			return true
+		}
+	}
+	l.isFloat, l.ival, l.fval, l.skipped = p.isFloat, p.ival, p.fval, 0
+	return false
+}
+
+// forget drops the state of the series of p, which is then sent by the next
+// flush whatever its value.
+func (s *suppressor) forget(p *point) {
+	delete(s.last, seriesKey{p.name, p.suffix, p.tagsID})
+}
+
+// prune forgets the series not exported since before, as they are gone from
+// the registry.
+func (s *suppressor) prune(before int64) {
+	for k, l := range s.last {
+		if l.seen < before {
+			delete(s.last, k)
+		}
+	}
+}
+
+// reset forgets every series so that they are all sent by the next flush.
+func (s *suppressor) reset() {
+	s.last = make(map[seriesKey]*lastPoint)
+}
+
+// suppressionRetention is how long the state of a series is kept once it is
+// no longer exported, long enough for it to be due again at its interval.
+func (t *TaggedOpenTSDB) suppressionRetention() time.Duration {
+	longest := t.FlushInterval
+	for d := range t.intervals {
+		if d > longest {
+			longest = d
+		}
+	}
+	return 2 * longest
+}
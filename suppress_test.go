@@ -0,0 +1,60 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSuppressUnchanged(t *testing.T) {
+	r := NewTaggedRegistry()
+	c := metrics.NewCounter()
+	r.Register("changing", Tags{"host": "a"}, c)
+	r.Register("constant", Tags{"host": "a"}, metrics.NewGauge())
+
+	var buf bytes.Buffer
+	var result FlushResult
+	clock := NewFakeClock(time.Unix(1505484300, 0))
+	e := &TaggedOpenTSDB{
+		Writer:             &buf,
+		Registry:           r,
+		FlushInterval:      10 * time.Second,
+		SuppressUnchanged:  true,
+		HeartbeatIntervals: 3,
+		OnFlush:            func(r FlushResult) { result = r },
+		Logger:             log.New(),
+		Clock:              clock,
+	}
+
+	var sent []int
+	for i := 0; i < 7; i++ {
+		buf.Reset()
+		c.Inc(1)
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(buf.Bytes(), []byte("put changing ")) {
+			t.Errorf("Flush %d: expected the changing series to be sent", i)
+		}
+		if bytes.Contains(buf.Bytes(), []byte("put constant ")) {
+			sent = append(sent, i)
+		}
+		clock.Advance(e.FlushInterval)
+	}
+
+	expected := []int{0, 3, 6}
+	if len(sent) != len(expected) {
+		t.Fatalf("Expected the constant series sent at flushes %v, got %v", expected, sent)
+	}
+	for i := range sent {
+		if sent[i] != expected[i] {
+			t.Fatalf("Expected the constant series sent at flushes %v, got %v", expected, sent)
+		}
+	}
+	if result.Suppressed != 0 {
+		t.Errorf("Expected nothing suppressed on a heartbeat, got %d", result.Suppressed)
+	}
+}
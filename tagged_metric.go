@@ -1,5 +1,7 @@
 package tsdmetrics
 
+import "time"
+
 type TaggedMetric interface {
 	GetTags() Tags
 	GetMetric() interface{}
@@ -10,8 +12,18 @@ type TaggedMetric interface {
 }
 
 type DefaultTaggedMetric struct {
-	Tags   Tags
-	Metric interface{}
+	Tags     Tags
+	Metric   interface{}
+	Interval time.Duration // Export interval, the exporter's FlushInterval when 0
+
+	id      TagsID // Cached Tags.TagsID(), set when the metric is registered
+	oneShot bool   // Added with Add()
+
+	// Idle tracking, maintained by the registry's eviction sweeps.
+	evictable  bool // Registered by GetOrRegister, which registers it again when needed
+	lastActive time.Time
+	activity   uint64 // Value summarizing the metric's updates at the last sweep
+	accessed   bool   // Looked up since the last sweep
 }
 
 func (m *DefaultTaggedMetric) GetTags() Tags {
@@ -23,7 +35,14 @@ func (m *DefaultTaggedMetric) GetMetric() interface{} {
 }
 
 func (m *DefaultTaggedMetric) GetTagsID() TagsID {
-	return m.GetTagsID()
+	if m.id == "" && len(m.Tags) > 0 {
+		m.id = m.Tags.TagsID()
+	}
+	return m.id
+}
+
+func (m *DefaultTaggedMetric) GetInterval() time.Duration {
+	return m.Interval
 }
 
 func (m *DefaultTaggedMetric) AddTags(tags Tags) TaggedMetric {
@@ -31,6 +50,8 @@ func (m *DefaultTaggedMetric) AddTags(tags Tags) TaggedMetric {
 
 	newStm.Metric = m.Metric
 	newStm.Tags = m.Tags.AddTags(tags)
+	newStm.Interval = m.Interval
+	newStm.oneShot = m.oneShot
 
 	return &newStm
 }
@@ -3,15 +3,15 @@ package tsdmetrics
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
-	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -20,8 +20,39 @@ type OpenTSDBFormat int
 const (
 	Tcollector OpenTSDBFormat = iota
 	Json
+	JsonLines // One Json point per line, only for Writer
+	Table     // Human-readable table, only for Writer
 )
 
+var formatNames = map[OpenTSDBFormat]string{
+	Tcollector: "tcollector",
+	Json:       "json",
+	JsonLines:  "jsonlines",
+	Table:      "table",
+}
+
+func (f OpenTSDBFormat) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("OpenTSDBFormat(%d)", int(f))
+}
+
+func (f OpenTSDBFormat) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText parses a format from its lowercase name.
+func (f *OpenTSDBFormat) UnmarshalText(b []byte) error {
+	for format, name := range formatNames {
+		if string(b) == name {
+			*f = format
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown format: %s", b)
+}
+
 type OpenTSDBPoint struct {
 	Metric    string            `json:"metric"`
 	Value     interface{}       `json:"value"`
@@ -32,255 +63,347 @@ type OpenTSDBPoint struct {
 // TaggedOpenTSDBConfig provides a container with configuration parameters for
 // the TaggedOpenTSDB exporter
 type TaggedOpenTSDB struct {
-	Addr          string         // Network address to connect to
-	Registry      TaggedRegistry // Registry to be exported
-	FlushInterval time.Duration  // Flush interval
-	DurationUnit  time.Duration  // Time conversion unit for durations
-	Format        OpenTSDBFormat
-	Compress      bool
-	BulkSize      int
+	Addr             string         // Network address to connect to
+	Writer           io.Writer      // Written to instead of Addr when set
+	Registry         TaggedRegistry // Registry to be exported
+	FlushInterval    time.Duration  // Flush interval
+	AlignFlushes     bool           // Flush on multiples of FlushInterval and timestamp points with them
+	FlushSplay       time.Duration  // Upper bound of the random delay applied to aligned flushes
+	DurationUnit     time.Duration  // Time conversion unit for durations, time.Millisecond when 0
+	Format           OpenTSDBFormat
+	Compress         bool        // Shorthand for Gzip when Compression is not set
+	Compression      Compression // Json request body codec
+	CompressionLevel int         // Codec specific level, 0 for the codec's default
+	BulkSize         int         // Maximum points per Json request, 0 for no limit
+	MaxBulkBytes     int         // Maximum Json request body size after compression, 0 for no limit
+
+	Aggregation *Aggregation  // Rules merging series before they are relabeled
+	Relabeling  *Relabeling   // Rules rewriting series before they are filtered
+	Filter      *SeriesFilter // Series exported, all when nil
+	Tags        Tags          // Added to the exported series without them
+	Validation  *Validation   // Checks of names and tags, none when nil
+
+	Pipeline Pipeline // Stages of the flushes of the run loop
+
+	RateLimit *RateLimit // Budget of the exports, unlimited when nil
+
+	// Skip the points whose value is the one last sent for their series,
+	// sending them anyway every HeartbeatIntervals flushes unless it is 0.
+	SuppressUnchanged  bool
+	HeartbeatIntervals int
+
+	ShutdownTimeout time.Duration // Deadline of the last flush when stopping, FlushInterval when 0
+
+	// Annotations queued with Annotate are posted at every flush to
+	// AnnotationAddr, or to the /api/annotation endpoint of the server at
+	// Addr when empty.
+	AnnotationAddr        string
+	MaxPendingAnnotations int // Annotations kept while undelivered, DefaultMaxPendingAnnotations when 0
+
+	Clock Clock // Source of time of the exporter, RealClock when nil
+
+	// Called synchronously after every flush with its outcome.
+	OnFlush func(FlushResult)
+
+	// Exporter self-instrumentation, registered under the "tsdmetrics.exporter"
+	// prefix in SelfMetricsRegistry, or Registry when nil. Tagged with
+	// SelfMetricsTags, or DefaultSelfMetricsTags when nil. Turning
+	// SelfMetrics on or off takes effect at the next flush.
+	SelfMetrics         bool
+	SelfMetricsRegistry TaggedRegistry
+	SelfMetricsTags     Tags
 
 	Logger log.FieldLogger
 
-	netAddr *net.TCPAddr
+	netAddr         *net.TCPAddr
+	tcollector      *tcollectorWriter
+	selfMetricsOnce sync.Once
+	metrics         *exporterMetrics
+	selfRegistry    *SegmentedTaggedRegistry // Where the metrics are registered, nil when they are not
+	flushMutex      sync.Mutex
+	due             map[time.Duration]bool // Intervals exported by the current flush, nil for all
+	stats           *flushStats            // Outcome of the current flush
+	suppressor      *suppressor
+	limiter         *rateLimiter
+	health          exporterStatus
+	annotations     annotationQueue
+	intervals       map[time.Duration]bool // Intervals seen in the registry
+	lifecycleOnce   sync.Once
+	lifecycle       *lifecycle
 }
 
-// TaggedOpenTSDBWithConfig is a blocking exporter function just like TaggedOpenTSDB,
-// but it takes a TaggedOpenTSDBConfig instead.
+// Run exports the registry every FlushInterval until ctx is cancelled or
+// Close is called, then flushes one last time. Each flush goes through the
+// stages of Pipeline. It can be called again once ctx is cancelled, but not
+// while it is running. After Close, it flushes once and returns.
 func (t *TaggedOpenTSDB) Run(ctx context.Context) {
-	tick := time.Tick(t.FlushInterval)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-tick:
-			if err := t.taggedOpenTSDB(); nil != err {
-				t.Logger.Error(err)
-			}
+	t.runPipeline(ctx, t.Pipeline)
+}
+
+// RunWithPreprocessing is Run calling every fn on the registry before each
+// flush, after the collectors of Pipeline.
+//
+// Deprecated: use Pipeline.Collectors.
+func (t *TaggedOpenTSDB) RunWithPreprocessing(ctx context.Context, fn []func(TaggedRegistry)) {
+	t.RunWithProcessing(ctx, fn, nil)
+}
+
+// RunWithProcessing is Run calling every preFn on the registry before each
+// flush and every postFn after it, after the collectors and hooks of
+// Pipeline.
+//
+// Deprecated: use Pipeline.Collectors and Pipeline.Hooks.
+func (t *TaggedOpenTSDB) RunWithProcessing(ctx context.Context, preFn, postFn []func(TaggedRegistry)) {
+	p := t.Pipeline
+	p.Collectors = append([]Collector{}, p.Collectors...)
+	for _, f := range preFn {
+		f := f
+		p.Collectors = append(p.Collectors, CollectorFunc(func(_ context.Context, r TaggedRegistry) error {
+			f(r)
+			return nil
+		}))
+	}
+	p.Hooks = append([]Hook{}, p.Hooks...)
+	for _, f := range postFn {
+		f := f
+		p.Hooks = append(p.Hooks, HookFunc(func(_ context.Context, r TaggedRegistry, _ FlushResult) error {
+			f(r)
+			return nil
+		}))
+	}
+	t.runPipeline(ctx, p)
+}
+
+// Export flushes the registry right away. Unlike Flush, it does not go through
+// the run loop, its collectors and its hooks.
+func (t *TaggedOpenTSDB) Export() error {
+	return t.taggedOpenTSDB(context.Background(), t.clock().Now()).Err
+}
+
+// taggedOpenTSDB exports the registry with points stamped at ts.
+func (t *TaggedOpenTSDB) taggedOpenTSDB(ctx context.Context, ts time.Time) FlushResult {
+	t.flushMutex.Lock()
+	defer t.flushMutex.Unlock()
+
+	if err := t.compileTransformers(); err != nil {
+		result := FlushResult{Timestamp: ts, Err: err}
+		t.updateStatus(t.clock().Now(), result)
+		return result
+	}
+
+	if t.RateLimit != nil {
+		if t.limiter == nil || t.limiter.config != t.RateLimit {
+			t.limiter = t.newRateLimiter(t.RateLimit)
+		}
+		t.limiter.ctx, t.limiter.shed = ctx, false
+		t.limiter.until = time.Time{}
+		if t.FlushInterval > 0 {
+			t.limiter.until = t.clock().Now().Add(t.FlushInterval)
+		}
+	} else {
+		t.limiter = nil
+	}
+
+	t.due = dueIntervals(ctx)
+	m := t.selfMetrics()
+	clock := t.clock()
+	start := clock.Now()
+	now := ts.Unix()
+
+	stats := flushStats{queued: pending(t.Registry)}
+	t.stats = &stats
+	defer func() { t.stats = nil }()
+	var err error
+	if t.Writer != nil {
+		err = t.exportWriter(now, &stats)
+	} else if t.Format == Tcollector {
+		err = t.exportTcollector(ctx, now, &stats)
+	} else if t.Format == Json {
+		err = t.exportJSON(ctx, now, &stats)
+	}
+	if err != nil {
+		stats.failedBulks++
+	}
+	if t.suppressor != nil {
+		if err != nil || stats.failedBulks > 0 {
+			// Points skipped later must have been received.
+			t.suppressor.reset()
+		} else {
+			t.suppressor.prune(ts.Add(-t.suppressionRetention()).Unix())
 		}
 	}
+	if aerr := t.sendAnnotations(ctx, &stats); err == nil {
+		err = aerr
+	}
+
+	duration := clock.Now().Sub(start)
+	m.update(&stats, start, duration)
+	result := stats.result(ts, duration, err)
+	t.updateStatus(start, result)
+	if t.OnFlush != nil {
+		t.OnFlush(result)
+	}
+	return result
 }
 
-func (t *TaggedOpenTSDB) RunWithPreprocessing(ctx context.Context, fn []func(TaggedRegistry)) {
-	tick := time.Tick(t.FlushInterval)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-tick:
-			for _, f := range fn {
-				f(t.Registry)
-			}
-			if err := t.taggedOpenTSDB(); nil != err {
-				t.Logger.Println(err)
-			}
+func (t *TaggedOpenTSDB) exportTcollector(ctx context.Context, now int64, stats *flushStats) error {
+	if t.netAddr == nil {
+		addr, err := net.ResolveTCPAddr("tcp", t.Addr)
+		if err != nil {
+			return err
 		}
+		t.netAddr = addr
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.netAddr.String())
+	if nil != err {
+		return err
 	}
+	defer conn.Close()
+
+	cw := &countingWriter{w: &deadlineWriter{ctx: ctx, conn: conn, timeout: t.FlushInterval}}
+	err = t.writeTcollector(cw, now, stats)
+	stats.bytes += cw.n
+	return err
 }
 
-func (t *TaggedOpenTSDB) RunWithProcessing(ctx context.Context, preFn, postFn []func(TaggedRegistry)) {
-	tick := time.Tick(t.FlushInterval)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-tick:
-			if preFn != nil {
-				for _, f := range preFn {
-					f(t.Registry)
-				}
-			}
+// deadlineWriter bounds each write to conn by timeout and the deadline of
+// ctx, so that the time spent waiting for the rate limit between writes does
+// not count.
+type deadlineWriter struct {
+	ctx     context.Context
+	conn    net.Conn
+	timeout time.Duration
+}
 
-			if err := t.taggedOpenTSDB(); nil != err {
-				t.Logger.Println(err)
-			}
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	var deadline time.Time
+	if w.timeout > 0 {
+		deadline = time.Now().Add(w.timeout)
+	}
+	if dl, ok := w.ctx.Deadline(); ok && (deadline.IsZero() || dl.Before(deadline)) {
+		deadline = dl
+	}
+	w.conn.SetWriteDeadline(deadline)
+	return w.conn.Write(b)
+}
 
-			if postFn != nil {
-				for _, f := range postFn {
-					f(t.Registry)
-				}
+// writeTcollector writes the registry to w in the Tcollector format.
+func (t *TaggedOpenTSDB) writeTcollector(w io.Writer, now int64, stats *flushStats) error {
+	if t.tcollector == nil {
+		t.tcollector = newTcollectorWriter()
+	}
+	bw := bufio.NewWriter(w)
+	t.tcollector.Reset(bw)
+
+	var err error
+	t.eachTcollectorPoint(now, func(p *point) {
+		if err == nil {
+			if err = t.tcollector.Write(p); err == nil {
+				stats.points++
 			}
 		}
+	})
+	t.tcollector.Prune()
+	if err == nil {
+		err = bw.Flush()
 	}
+	return err
 }
 
-func (t *TaggedOpenTSDB) Export() error {
-	return t.taggedOpenTSDB()
+func (t *TaggedOpenTSDB) exportJSON(ctx context.Context, now int64, stats *flushStats) error {
+	c := http.Client{Timeout: t.FlushInterval}
+	return t.encodeJSON(now, func(body *bytes.Buffer, points int) {
+		t.postJSON(ctx, &c, t.compression(), body, points, stats)
+	})
 }
 
-func (t *TaggedOpenTSDB) taggedOpenTSDB() error {
-	now := time.Now().Unix()
-	du := float64(t.DurationUnit)
-
-	if t.Format == Tcollector {
-		conn, err := net.DialTCP("tcp", nil, t.netAddr)
-		if nil != err {
+// encodeJSON streams the registry in Json bulks to send.
+func (t *TaggedOpenTSDB) encodeJSON(now int64, send func(body *bytes.Buffer, points int)) error {
+	codec := t.compression()
+	var cw compressor
+	if codec != NoCompression {
+		var err error
+		if cw, err = getCompressor(codec, t.CompressionLevel, nil); err != nil {
 			return err
 		}
-		defer conn.Close()
-		conn.SetWriteDeadline(time.Now().Add(time.Second * t.FlushInterval))
-
-		w := bufio.NewWriter(conn)
-		t.Registry.Each(func(name string, tm TaggedMetric) {
-			tags := tm.GetTags()
-			switch metric := tm.GetMetric().(type) {
-			case metrics.Counter:
-				fmt.Fprintf(w, "put %s %d %d %s\n", name, now, metric.Count(), tags.String())
-			case metrics.Gauge:
-				fmt.Fprintf(w, "put %s %d %d %s\n", name, now, metric.Value(), tags.String())
-			case metrics.GaugeFloat64:
-				fmt.Fprintf(w, "put %s %d %f %s\n", name, now, metric.Value(), tags.String())
-			case metrics.Histogram:
-				h := metric.Snapshot()
-				ps := h.Percentiles([]float64{0.5, 0.75, 0.90, 0.95, 0.99})
-				fmt.Fprintf(w, "put %s.count %d %d %s\n", name, now, h.Count(), tags.String())
-				fmt.Fprintf(w, "put %s.min %d %d %s\n", name, now, h.Min(), tags.String())
-				fmt.Fprintf(w, "put %s.max %d %d %s\n", name, now, h.Max(), tags.String())
-				fmt.Fprintf(w, "put %s.mean %d %.2f %s\n", name, now, h.Mean(), tags.String())
-				fmt.Fprintf(w, "put %s.std-dev %d %.2f %s\n", name, now, h.StdDev(), tags.String())
-				fmt.Fprintf(w, "put %s.p50 %d %.2f %s\n", name, now, ps[0], tags.String())
-				fmt.Fprintf(w, "put %s.p75 %d %.2f %s\n", name, now, ps[1], tags.String())
-				fmt.Fprintf(w, "put %s.p90 %d %.2f %s\n", name, now, ps[2], tags.String())
-				fmt.Fprintf(w, "put %s.p95 %d %.2f %s\n", name, now, ps[3], tags.String())
-				fmt.Fprintf(w, "put %s.p99 %d %.2f %s\n", name, now, ps[4], tags.String())
-			case metrics.Meter:
-				m := metric.Snapshot()
-				fmt.Fprintf(w, "put %s %d %d %s\n", name, now, m.Count(), tags.String())
-				fmt.Fprintf(w, "put %s.1m-rate %d %.2f %s\n", name, now, m.Rate1(), tags.String())
-				fmt.Fprintf(w, "put %s.5m-rate %d %.2f %s\n", name, now, m.Rate5(), tags.String())
-				fmt.Fprintf(w, "put %s.15m-rate %d %.2f %s\n", name, now, m.Rate15(), tags.String())
-				fmt.Fprintf(w, "put %s.mean-rate %d %.2f %s\n", name, now, m.RateMean(), tags.String())
-			case metrics.Timer:
-				t := metric.Snapshot()
-				ps := t.Percentiles([]float64{0.5, 0.75, 0.90, 0.95, 0.99})
-				fmt.Fprintf(w, "put %s.count %d %d %s\n", name, now, t.Count(), tags.String())
-				fmt.Fprintf(w, "put %s.min %d %d %s\n", name, now, t.Min()/int64(du), tags.String())
-				fmt.Fprintf(w, "put %s.max %d %d %s\n", name, now, t.Max()/int64(du), tags.String())
-				fmt.Fprintf(w, "put %s.mean %d %.2f %s\n", name, now, t.Mean()/du, tags.String())
-				fmt.Fprintf(w, "put %s.std-dev %d %.2f %s\n", name, now, t.StdDev()/du, tags.String())
-				fmt.Fprintf(w, "put %s.p50 %d %.2f %s\n", name, now, ps[0]/du, tags.String())
-				fmt.Fprintf(w, "put %s.p75 %d %.2f %s\n", name, now, ps[1]/du, tags.String())
-				fmt.Fprintf(w, "put %s.p90 %d %.2f %s\n", name, now, ps[2]/du, tags.String())
-				fmt.Fprintf(w, "put %s.p95 %d %.2f %s\n", name, now, ps[3]/du, tags.String())
-				fmt.Fprintf(w, "put %s.p99 %d %.2f %s\n", name, now, ps[4]/du, tags.String())
-				fmt.Fprintf(w, "put %s.1m-rate %d %.2f %s\n", name, now, t.Rate1(), tags.String())
-				fmt.Fprintf(w, "put %s.5m-rate %d %.2f %s\n", name, now, t.Rate5(), tags.String())
-				fmt.Fprintf(w, "put %s.15m-rate %d %.2f %s\n", name, now, t.Rate15(), tags.String())
-				fmt.Fprintf(w, "put %s.mean-rate %d %.2f %s\n", name, now, t.RateMean(), tags.String())
-			}
-			w.Flush()
-		})
-	} else if t.Format == Json {
-		var tsd []OpenTSDBPoint
-		t.Registry.Each(func(name string, tm TaggedMetric) {
-			tags := tm.GetTags()
-			switch metric := tm.GetMetric().(type) {
-			case metrics.Counter:
-				tsd = append(tsd, OpenTSDBPoint{Metric: name, Timestamp: now, Value: metric.Count(), Tags: tags})
-			case metrics.Gauge:
-				tsd = append(tsd, OpenTSDBPoint{Metric: name, Timestamp: now, Value: metric.Value(), Tags: tags})
-			case metrics.GaugeFloat64:
-				tsd = append(tsd, OpenTSDBPoint{Metric: name, Timestamp: now, Value: metric.Value(), Tags: tags})
-			case metrics.Histogram:
-				h := metric.Snapshot()
-				ps := h.Percentiles([]float64{0.5, 0.75, 0.90, 0.95, 0.99})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".count", Timestamp: now, Value: h.Count(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".min", Timestamp: now, Value: h.Min(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".max", Timestamp: now, Value: h.Max(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".mean", Timestamp: now, Value: h.Mean(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".std-dev", Timestamp: now, Value: h.StdDev(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p50", Timestamp: now, Value: ps[0], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p75", Timestamp: now, Value: ps[1], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p95", Timestamp: now, Value: ps[2], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p99", Timestamp: now, Value: ps[3], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p999", Timestamp: now, Value: ps[4], Tags: tags})
-			case metrics.Meter:
-				m := metric.Snapshot()
-				tsd = append(tsd, OpenTSDBPoint{Metric: name, Timestamp: now, Value: m.Count(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".1m", Timestamp: now, Value: m.Rate1(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".5m", Timestamp: now, Value: m.Rate5(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".15m", Timestamp: now, Value: m.Rate15(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".mean-rate", Timestamp: now, Value: m.RateMean(), Tags: tags})
-			case metrics.Timer:
-				t := metric.Snapshot()
-				ps := t.Percentiles([]float64{0.5, 0.75, 0.90, 0.95, 0.99})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".count", Timestamp: now, Value: t.Count(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".min", Timestamp: now, Value: t.Min(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".max", Timestamp: now, Value: t.Max(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".mean", Timestamp: now, Value: t.Mean(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".std-dev", Timestamp: now, Value: t.StdDev(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p50", Timestamp: now, Value: ps[0], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p75", Timestamp: now, Value: ps[1], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p95", Timestamp: now, Value: ps[2], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p99", Timestamp: now, Value: ps[3], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p999", Timestamp: now, Value: ps[4], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".1m", Timestamp: now, Value: t.Rate1(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".5m", Timestamp: now, Value: t.Rate5(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".15m", Timestamp: now, Value: t.Rate15(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".mean-rate", Timestamp: now, Value: t.RateMean(), Tags: tags})
-			case IntegerHistogram:
-				h := metric.Snapshot()
-				ps := h.Percentiles([]float64{0.5, 0.75, 0.90, 0.95, 0.99})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".count", Timestamp: now, Value: h.Count(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".min", Timestamp: now, Value: h.Min(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".max", Timestamp: now, Value: h.Max(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".mean", Timestamp: now, Value: h.Mean(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".std-dev", Timestamp: now, Value: h.StdDev(), Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p50", Timestamp: now, Value: ps[0], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p75", Timestamp: now, Value: ps[1], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p95", Timestamp: now, Value: ps[2], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p99", Timestamp: now, Value: ps[3], Tags: tags})
-				tsd = append(tsd, OpenTSDBPoint{Metric: name + ".p999", Timestamp: now, Value: ps[4], Tags: tags})
-			}
-		})
+		defer putCompressor(codec, t.CompressionLevel, cw)
+	}
 
-		if len(tsd) == 0 {
-			t.Logger.Info("Nothing to send")
-			return nil
-		}
+	enc := newJSONBulkEncoder(t.BulkSize, t.MaxBulkBytes, cw, send)
 
-		bulkSize := t.BulkSize
-		if t.BulkSize == 0 {
-			bulkSize = len(tsd)
+	var err error
+	t.eachJSONPoint(now, func(p *point) {
+		if err == nil {
+			err = enc.Encode(p)
 		}
+	})
+	if err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to serialize metrics json: %s", err)
+	}
 
-		for i := 0; i < len(tsd); i += bulkSize {
-			if i+bulkSize > len(tsd) {
-				bulkSize = len(tsd) - i
-			}
+	if enc.total == 0 {
+		t.Logger.Info("Nothing to send")
+	}
+	return nil
+}
 
-			buf := &bytes.Buffer{}
-			if t.Compress {
-				w := gzip.NewWriter(buf)
-				err := json.NewEncoder(w).Encode(tsd[i : i+bulkSize])
-				w.Close()
-				if err != nil {
-					t.Logger.Printf("Unable to serialize metrics json: %s", err)
-					return nil
-				}
-			} else if err := json.NewEncoder(buf).Encode(tsd[i : i+bulkSize]); err != nil {
-				t.Logger.Printf("Unable to serialize metrics json: %s", err)
-				return nil
-			}
+func (t *TaggedOpenTSDB) compression() Compression {
+	if t.Compression == NoCompression && t.Compress {
+		return Gzip
+	}
+	return t.Compression
+}
 
-			if req, err := http.NewRequest(http.MethodPost, t.Addr, buf); err != nil {
-				t.Logger.Printf("Unable to create a new request: %s", err)
-			} else {
-				req.Header.Set("Content-Type", "application/json")
-				if t.Compress {
-					req.Header.Set("Content-Encoding", "gzip")
-				}
-				c := http.Client{Timeout: t.FlushInterval}
-				if resp, err := c.Do(req); err != nil {
-					t.Logger.Printf("Unable to send out metrics: %s", err)
-				} else {
-					resp.Body.Close()
-					if resp.StatusCode != 204 {
-						t.Logger.Printf("Unexpected return code sending metrics: %d", resp.StatusCode)
-					}
-				}
-			}
+func (t *TaggedOpenTSDB) postJSON(ctx context.Context, c *http.Client, codec Compression, body *bytes.Buffer, points int, stats *flushStats) {
+	size := body.Len()
+	req, err := http.NewRequest(http.MethodPost, t.Addr, body)
+	if err != nil {
+		t.Logger.Printf("Unable to create a new request: %s", err)
+		stats.failedBulks++
+		return
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if codec != NoCompression {
+		req.Header.Set("Content-Encoding", codec.ContentEncoding())
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Logger.Printf("Unable to send out metrics: %s", err)
+		stats.failedBulks++
+		return
+	}
+	defer resp.Body.Close()
+	stats.bytes += int64(size)
+
+	// OpenTSDB reports how many points failed when asked for a summary or
+	// details, otherwise a non 2xx status means the whole bulk was refused.
+	var summary struct {
+		Failed *int `json:"failed"`
+	}
+	json.NewDecoder(resp.Body).Decode(&summary)
+
+	switch {
+	case resp.StatusCode == 200 || resp.StatusCode == 204:
+		stats.points += int64(points)
+		if summary.Failed != nil {
+			stats.points -= int64(*summary.Failed)
+			stats.rejected += int64(*summary.Failed)
+		}
+	default:
+		t.Logger.Printf("Unexpected return code sending metrics: %d", resp.StatusCode)
+		if summary.Failed != nil {
+			stats.points += int64(points - *summary.Failed)
+			stats.rejected += int64(*summary.Failed)
+		} else {
+			stats.failedBulks++
+			stats.rejected += int64(points)
 		}
 	}
-	return nil
 }
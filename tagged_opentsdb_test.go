@@ -1,20 +1,41 @@
 package tsdmetrics
 
 import (
+	"context"
 	"time"
 
-	"context"
+	log "github.com/sirupsen/logrus"
 )
 
 func ExampleTaggedOpenTSDB() {
-	go TaggedOpenTSDB(context.Background(), DefaultTaggedRegistry, 1*time.Second, "some.prefix", ":2003", Tcollector)
+	e := &TaggedOpenTSDB{
+		Addr:          ":4242",
+		Registry:      NewTaggedRegistry(),
+		FlushInterval: 10 * time.Second,
+		DurationUnit:  time.Millisecond,
+		Format:        Tcollector,
+		Logger:        log.New(),
+	}
+	go e.Run(context.Background())
 }
 
-func ExampleTaggedOpenTSDBWithConfig() {
-	go TaggedOpenTSDBWithConfig(context.Background(), TaggedOpenTSDBConfig{
-		Addr:          ":2003",
-		Registry:      DefaultTaggedRegistry,
-		FlushInterval: 1 * time.Second,
-		DurationUnit:  time.Millisecond,
-	})
+func ExamplePipeline() {
+	e := &TaggedOpenTSDB{
+		Addr:          "http://localhost:4242/api/put",
+		Registry:      NewTaggedRegistry(),
+		FlushInterval: 10 * time.Second,
+		Format:        Json,
+		Logger:        log.New(),
+		Pipeline: Pipeline{
+			Collectors: []Collector{CollectorFunc(func(ctx context.Context, r TaggedRegistry) error {
+				// Update gauges from an external source.
+				return nil
+			})},
+			Transformers: []Transformer{&SeriesFilter{Deny: []SeriesMatcher{{Name: "*.std-dev"}}}},
+			Hooks: []Hook{HookFunc(func(ctx context.Context, r TaggedRegistry, result FlushResult) error {
+				return result.Err
+			})},
+		},
+	}
+	go e.Run(context.Background())
 }
@@ -3,6 +3,7 @@ package tsdmetrics
 import (
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/rcrowley/go-metrics"
 )
@@ -47,6 +48,29 @@ type DefaultTaggedRegistry struct {
 	metrics           metricsStore
 	additionalMetrics metricsStore
 	mutex             sync.Mutex
+
+	series     int // Registered series, one-shot metrics excluded
+	limits     CardinalityLimits
+	overflowed metrics.Counter
+	refused    metrics.Counter
+
+	idleTTL time.Duration
+	onEvict func(string, TaggedMetric)
+}
+
+// CardinalityLimits bounds the number of series registered in a registry, to
+// protect the TSDs from tags taking unbounded values.
+//
+// Once a metric name has MaxSeriesPerMetric tag sets, its new tag sets are
+// registered as a single series tagged with Overflow instead, along with the
+// tags shared by all the series of the name. Once the registry holds
+// MaxSeries series, new tag sets of existing names also go to their overflow
+// series while new names are refused. When Overflow is nil, registrations
+// over the limits are refused with a CardinalityLimitExceeded error.
+type CardinalityLimits struct {
+	MaxSeriesPerMetric int  // 0 for no limit
+	MaxSeries          int  // 0 for no limit
+	Overflow           Tags // Tags of the overflow series, for example Tags{"overflow": "true"}
 }
 
 // Create a new registry.
@@ -80,6 +104,7 @@ func (r *DefaultTaggedRegistry) Get(name string, tags Tags) interface{} {
 	defer r.mutex.Unlock()
 	if t, ok := r.metrics[name]; ok {
 		if taggedMetric, ok := t[tags.TagsID()]; ok {
+			r.touch(taggedMetric)
 			return taggedMetric.GetMetric()
 		}
 	}
@@ -91,32 +116,207 @@ func (r *DefaultTaggedRegistry) Get(name string, tags Tags) interface{} {
 // The interface can be the metric to register if not found in registry,
 // or a function returning the metric for lazy instantiation.
 func (r *DefaultTaggedRegistry) GetOrRegister(name string, tags Tags, i interface{}) interface{} {
+	return r.getOrRegister(name, tags, i, 0)
+}
+
+// getOrRegister is GetOrRegister exporting the metric every d when it
+// registers it.
+func (r *DefaultTaggedRegistry) getOrRegister(name string, tags Tags, i interface{}, d time.Duration) interface{} {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	if t, ok := r.metrics[name]; ok {
 		if taggedMetric, ok := t[tags.TagsID()]; ok {
+			r.touch(taggedMetric)
 			return taggedMetric.GetMetric()
 		}
 	}
 	if v := reflect.ValueOf(i); v.Kind() == reflect.Func {
 		i = v.Call(nil)[0].Interface()
 	}
-	r.register(r.metrics, name, tags, i)
+
+	tags, overflow, err := r.admit(name, tags)
+	if err != nil {
+		// Refused metrics still work, they are just not exported.
+		return i
+	}
+	if overflow {
+		r.overflowed.Inc(1)
+		if t, ok := r.metrics[name][tags.TagsID()]; ok {
+			r.touch(t)
+			return t.GetMetric()
+		}
+	}
+	r.register(r.metrics, name, tags, i, false)
+	if m, ok := r.metrics[name][tags.TagsID()].(*DefaultTaggedMetric); ok {
+		m.evictable = true
+		m.Interval = d
+	}
 	return i
 }
 
 // Register the given metric under the given name.  Returns a DuplicateMetric
 // if a metric by the given name is already registered.
+//
+// Over the registry's cardinality limits, the metric is registered as the
+// overflow series of name, or a CardinalityLimitExceeded error is returned
+// when the overflow series already exists or is disabled.
 func (r *DefaultTaggedRegistry) Register(name string, tags Tags, i interface{}) error {
+	return r.registerEvery(name, tags, i, 0)
+}
+
+// registerEvery is Register exporting the metric every d.
+func (r *DefaultTaggedRegistry) registerEvery(name string, tags Tags, i interface{}, d time.Duration) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	return r.register(r.metrics, name, tags, i)
+	admitted, overflow, err := r.admit(name, tags)
+	if err != nil {
+		return err
+	}
+	if overflow {
+		if _, ok := r.metrics[name][admitted.TagsID()]; ok {
+			r.refused.Inc(1)
+			return CardinalityLimitExceeded{name, tags}
+		}
+		r.overflowed.Inc(1)
+	}
+	if err := r.register(r.metrics, name, admitted, i, false); err != nil {
+		return err
+	}
+	if m, ok := r.metrics[name][admitted.TagsID()].(*DefaultTaggedMetric); ok {
+		m.Interval = d
+	}
+	return nil
+}
+
+// SetCardinalityLimits applies limits to the registrations to come. The
+// number of registrations sent to overflow series and refused are counted in
+// the registry itself as tsdmetrics.registry.overflowed and
+// tsdmetrics.registry.refused, tagged with DefaultSelfMetricsTags.
+func (r *DefaultTaggedRegistry) SetCardinalityLimits(limits CardinalityLimits) {
+	r.setCardinalityLimits(limits, "", DefaultSelfMetricsTags)
+}
+
+// setCardinalityLimits is SetCardinalityLimits registering the counters with
+// prefix and tags the first time.
+func (r *DefaultTaggedRegistry) setCardinalityLimits(limits CardinalityLimits, prefix string, tags Tags) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.limits = limits
+	if r.overflowed == nil {
+		r.overflowed = metrics.NewCounter()
+		r.refused = metrics.NewCounter()
+		r.register(r.metrics, prefix+"tsdmetrics.registry.overflowed", tags, r.overflowed, false)
+		r.register(r.metrics, prefix+"tsdmetrics.registry.refused", tags, r.refused, false)
+	}
+}
+
+// admit returns the tags under which a series is registered given the
+// cardinality limits and whether they are the overflow ones, or an error when
+// it is refused. The overflow series keeps the tags shared by all the series
+// of name, such as the host or the default tags of a segment.
+func (r *DefaultTaggedRegistry) admit(name string, tags Tags) (Tags, bool, error) {
+	l := r.limits
+	if l.MaxSeriesPerMetric <= 0 && l.MaxSeries <= 0 {
+		return tags, false, nil
+	}
+	existing := r.metrics[name]
+	if _, ok := existing[tags.TagsID()]; ok {
+		return tags, false, nil
+	}
+
+	perMetric := l.MaxSeriesPerMetric > 0 && len(existing) >= l.MaxSeriesPerMetric
+	global := l.MaxSeries > 0 && r.series >= l.MaxSeries
+	if !perMetric && !global {
+		return tags, false, nil
+	}
+	if l.Overflow == nil || len(existing) == 0 {
+		r.refused.Inc(1)
+		return nil, false, CardinalityLimitExceeded{name, tags}
+	}
+	shared := Tags{}
+	for k, v := range tags {
+		shared[k] = v
+	}
+	for _, m := range existing {
+		mtags := m.GetTags()
+		for k, v := range shared {
+			if mtags[k] != v {
+				delete(shared, k)
+			}
+		}
+	}
+	return l.Overflow.AddTags(shared), true, nil
 }
 
 func (r *DefaultTaggedRegistry) Add(name string, tags Tags, i interface{}) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	return r.register(r.additionalMetrics, name, tags, i)
+	return r.register(r.additionalMetrics, name, tags, i, true)
+}
+
+// SetMetricExportInterval sets the export interval of a registered metric. An
+// interval of 0 restores the exporter's FlushInterval.
+func (r *DefaultTaggedRegistry) SetMetricExportInterval(name string, tags Tags, d time.Duration) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	id := tags.TagsID()
+	if t, ok := r.metrics[name]; ok {
+		if m, ok := t[id].(*DefaultTaggedMetric); ok {
+			if m.Interval == d {
+				return nil
+			}
+			// The snapshots walked by exporters keep the current one, which is
+			// replaced rather than changed under them.
+			updated := *m
+			updated.Interval = d
+			t[id] = &updated
+			return nil
+		}
+	}
+	return UnknownTaggedMetric{name, tags}
+}
+
+// ExportIntervals returns the export intervals set on registered metrics,
+// those exported at the exporter's FlushInterval excepted.
+func (r *DefaultTaggedRegistry) ExportIntervals() []time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	seen := make(map[time.Duration]bool)
+	var intervals []time.Duration
+	for _, s := range []metricsStore{r.metrics, r.additionalMetrics} {
+		for _, t := range s {
+			for _, tm := range t {
+				if m, ok := tm.(*DefaultTaggedMetric); ok && m.Interval > 0 && !seen[m.Interval] {
+					seen[m.Interval] = true
+					intervals = append(intervals, m.Interval)
+				}
+			}
+		}
+	}
+	return intervals
+}
+
+// Pending returns the number of metrics added with Add() which have not been
+// reported yet.
+func (r *DefaultTaggedRegistry) Pending() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := 0
+	for _, t := range r.additionalMetrics {
+		n += len(t)
+	}
+	return n
+}
+
+// pending returns r's number of pending one-shot metrics, when it tracks them.
+func pending(r TaggedRegistry) int {
+	if p, ok := r.(interface {
+		Pending() int
+	}); ok {
+		return p.Pending()
+	}
+	return 0
 }
 
 // Run all registered healthchecks.
@@ -140,6 +340,7 @@ func (r *DefaultTaggedRegistry) Unregister(name string, tags Tags) {
 	if t, ok := r.metrics[name]; ok {
 		if _, ok := t[tags.TagsID()]; ok {
 			delete(t, tags.TagsID())
+			r.series--
 		}
 
 		if len(t) == 0 {
@@ -155,9 +356,10 @@ func (r *DefaultTaggedRegistry) UnregisterAll() {
 	for name, _ := range r.metrics {
 		delete(r.metrics, name)
 	}
+	r.series = 0
 }
 
-func (r *DefaultTaggedRegistry) register(s metricsStore, name string, tags Tags, i interface{}) error {
+func (r *DefaultTaggedRegistry) register(s metricsStore, name string, tags Tags, i interface{}, oneShot bool) error {
 	if t, ok := s[name]; ok {
 		if _, ok := t[tags.TagsID()]; ok {
 			return DuplicateTaggedMetric{name, tags}
@@ -168,23 +370,42 @@ func (r *DefaultTaggedRegistry) register(s metricsStore, name string, tags Tags,
 		if _, ok := s[name]; !ok {
 			s[name] = make(map[TagsID]TaggedMetric, 1)
 		}
-		taggedMetric := DefaultTaggedMetric{Tags: tags, Metric: i}
-		s[name][tags.TagsID()] = &taggedMetric
+		id := tags.TagsID()
+		taggedMetric := DefaultTaggedMetric{Tags: tags, Metric: i, id: id, oneShot: oneShot}
+		s[name][id] = &taggedMetric
+		if !oneShot {
+			r.series++
+		}
 	}
 	return nil
 }
 
+// registered returns a snapshot of the registered metrics, along with the
+// one-shot ones which are removed from the registry. The inner maps are
+// copied as registrations and eviction sweeps keep changing them while the
+// snapshot is walked.
 func (r *DefaultTaggedRegistry) registered() map[string]map[TagsID]TaggedMetric {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	metrics := make(map[string]map[TagsID]TaggedMetric, len(r.metrics))
-	for name, i := range r.metrics {
-		metrics[name] = i
+	for name, t := range r.metrics {
+		snapshot := make(map[TagsID]TaggedMetric, len(t))
+		for id, m := range t {
+			snapshot[id] = m
+		}
+		metrics[name] = snapshot
 	}
 
-	// Additional metrics
-	for name, i := range r.additionalMetrics {
-		metrics[name] = i
+	// Additional metrics, which are not changed once removed from the registry
+	for name, t := range r.additionalMetrics {
+		snapshot, ok := metrics[name]
+		if !ok {
+			metrics[name] = t
+			continue
+		}
+		for id, m := range t {
+			snapshot[id] = m
+		}
 	}
 	r.additionalMetrics = make(map[string]map[TagsID]TaggedMetric)
 
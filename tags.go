@@ -41,7 +41,10 @@ func (tm Tags) TagsID() TagsID {
 
 	var tagid bytes.Buffer
 	for _, k := range keys {
-		tagid.Write([]byte(fmt.Sprintf("%s=%s;", k, tm[k])))
+		tagid.WriteString(k)
+		tagid.WriteByte('=')
+		tagid.WriteString(tm[k])
+		tagid.WriteByte(';')
 	}
 
 	return TagsID(tagid.String())
@@ -0,0 +1,93 @@
+package tsdmetrics
+
+import (
+	"io"
+	"sort"
+	"strconv"
+)
+
+// tcollectorWriter formats points in the Tcollector line protocol:
+//
+//	put <metric> <timestamp> <value> <tagk1=tagv1 ...>
+//
+// The serialized tags are cached per TagsID and numbers are appended to a
+// reused buffer, so writing a point does not allocate once the cache is warm.
+type tcollectorWriter struct {
+	w    io.Writer
+	line []byte
+	tags map[TagsID]*tcollectorTags
+	gen  uint64
+}
+
+type tcollectorTags struct {
+	b   []byte
+	gen uint64 // Last flush the entry was used in
+}
+
+func newTcollectorWriter() *tcollectorWriter {
+	return &tcollectorWriter{tags: make(map[TagsID]*tcollectorTags)}
+}
+
+// Reset directs the following points to w and starts a new flush.
+func (tw *tcollectorWriter) Reset(w io.Writer) {
+	tw.w = w
+	tw.gen++
+}
+
+// Prune drops the cached tags which were not used since the last Reset.
+func (tw *tcollectorWriter) Prune() {
+	for id, e := range tw.tags {
+		if e.gen != tw.gen {
+			delete(tw.tags, id)
+		}
+	}
+}
+
+func (tw *tcollectorWriter) Write(p *point) error {
+	b := append(tw.line[:0], "put "...)
+	b = append(b, p.name...)
+	b = append(b, p.suffix...)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, p.timestamp, 10)
+	b = append(b, ' ')
+	if p.isFloat {
+		b = strconv.AppendFloat(b, p.fval, 'f', p.prec, 64)
+	} else {
+		b = strconv.AppendInt(b, p.ival, 10)
+	}
+	b = append(b, ' ')
+	b = append(b, tw.tagString(p.tagsID, p.tags)...)
+	b = append(b, '\n')
+	tw.line = b
+
+	_, err := tw.w.Write(b)
+	return err
+}
+
+func (tw *tcollectorWriter) tagString(id TagsID, tags Tags) []byte {
+	if e, ok := tw.tags[id]; ok {
+		e.gen = tw.gen
+		return e.b
+	}
+
+	e := &tcollectorTags{b: appendTags(nil, tags), gen: tw.gen}
+	tw.tags[id] = e
+	return e.b
+}
+
+// appendTags serializes tags the same way as Tags.String, sorted by key.
+func appendTags(b []byte, tags Tags) []byte {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b = append(b, k...)
+		b = append(b, '=')
+		b = append(b, tags[k]...)
+		b = append(b, ' ')
+	}
+	return b
+}
@@ -0,0 +1,63 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestTcollectorWriter(t *testing.T) {
+	var buf bytes.Buffer
+	tw := newTcollectorWriter()
+	tw.Reset(&buf)
+
+	tags := Tags{"b": "2", "a": "1"}
+	p := point{name: "test", tags: tags, tagsID: tags.TagsID(), timestamp: 10}
+	p.emitInt(func(p *point) { tw.Write(p) }, ".count", 42)
+	p.emitFloat(func(p *point) { tw.Write(p) }, ".mean", 1.005)
+	p.emitFloatPrec(func(p *point) { tw.Write(p) }, "", 0.5, 6)
+
+	expected := fmt.Sprintf("put test.count 10 %d a=1 b=2 \n", 42) +
+		fmt.Sprintf("put test.mean 10 %.2f a=1 b=2 \n", 1.005) +
+		fmt.Sprintf("put test 10 %f a=1 b=2 \n", 0.5)
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	tw.Reset(&buf)
+	tw.Prune()
+	if len(tw.tags) != 0 {
+		t.Errorf("Unused tags should have been pruned, %d left", len(tw.tags))
+	}
+}
+
+func BenchmarkTcollectorWriter(b *testing.B) {
+	r := NewTaggedRegistry()
+	for i := 0; i < 100; i++ {
+		tags := Tags{"host": "localhost", "endpoint": fmt.Sprintf("/api/%d", i)}
+		r.Register("requests", tags, metrics.NewCounter())
+		h := metrics.NewHistogram(metrics.NewUniformSample(100))
+		h.Update(int64(i))
+		r.Register("latency", tags, h)
+	}
+
+	t := &TaggedOpenTSDB{Registry: r, Format: Tcollector}
+	tw := newTcollectorWriter()
+	points := 0
+	write := func(p *point) {
+		tw.Write(p)
+		points++
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tw.Reset(ioutil.Discard)
+		t.eachTcollectorPoint(int64(i), write)
+		tw.Prune()
+	}
+	b.ReportMetric(float64(points)/float64(b.N), "points/op")
+}
@@ -0,0 +1,81 @@
+package tsdmetrics
+
+// ValidationPolicy is what the exporter does with series which OpenTSDB
+// would refuse or which would corrupt the Tcollector line format.
+type ValidationPolicy int
+
+const (
+	NoValidation ValidationPolicy = iota
+	Sanitize                      // Replace invalid characters with '_' and drop what cannot be fixed
+	Reject                        // Drop invalid series
+)
+
+// Validation checks every exported metric name, tag key and tag value.
+// Series with more than MaxTags tags are dropped whatever the policy.
+type Validation struct {
+	Policy      ValidationPolicy
+	MaxTags     int  // Tags per series accepted by the server (tsd.storage.max_tags), 0 for no limit
+	DefaultTags Tags // Given to series without tags, which OpenTSDB refuses
+}
+
+func validOpenTSDB(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if CleanOpenTSDBRune(r, 0) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validate returns the name and tags of a series as they must be exported,
+// whether they were corrected, and false when the series must be dropped.
+// tags is not modified. Series which cannot be sanitized without merging two
+// of their tags or dropping some of them are dropped: they would otherwise be
+// exported as, and overwrite, another series.
+func (v *Validation) validate(name string, tags Tags) (string, Tags, bool, bool) {
+	corrected := false
+	if !validOpenTSDB(name) {
+		if v.Policy == Reject || name == "" {
+			return name, tags, false, false
+		}
+		name, corrected = CleanOpenTSDB(name), true
+	}
+
+	copied := false
+	for k, val := range tags {
+		if validOpenTSDB(k) && validOpenTSDB(val) {
+			continue
+		}
+		if v.Policy == Reject {
+			return name, tags, false, false
+		}
+		if !copied {
+			tags, copied = copyTags(tags), true
+		}
+		delete(tags, k)
+		if k != "" && val != "" {
+			clean := CleanOpenTSDB(k)
+			if _, ok := tags[clean]; ok {
+				return name, tags, false, false
+			}
+			tags[clean] = CleanOpenTSDB(val)
+		}
+		corrected = true
+	}
+
+	if len(tags) == 0 && len(v.DefaultTags) > 0 {
+		tags, corrected = copyTags(v.DefaultTags), true
+	}
+
+	if v.MaxTags > 0 && len(tags) > v.MaxTags {
+		return name, tags, false, false
+	}
+
+	if len(tags) == 0 && v.Policy == Reject {
+		return name, tags, false, false
+	}
+	return name, tags, corrected, true
+}
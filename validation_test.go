@@ -0,0 +1,57 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestValidation(t *testing.T) {
+	newRegistry := func() TaggedRegistry {
+		r := NewTaggedRegistry()
+		r.Register("ok", Tags{"host": "a"}, metrics.NewCounter())
+		r.Register("bad name", Tags{"host": "a"}, metrics.NewCounter())
+		r.Register("badtag", Tags{"host": "a b=c", "empty": ""}, metrics.NewCounter())
+		r.Register("untagged", Tags{}, metrics.NewCounter())
+		r.Register("wide", Tags{"a": "1", "b": "2", "c": "3"}, metrics.NewCounter())
+		r.Register("collision", Tags{"a b": "1", "a_b": "2"}, metrics.NewCounter())
+		return r
+	}
+
+	for _, c := range []struct {
+		policy             ValidationPolicy
+		expected           string
+		sanitized, invalid int64
+	}{
+		{Sanitize, "put bad_name 1505484300 0 host=a \n" +
+			"put badtag 1505484300 0 host=a_b_c \n" +
+			"put ok 1505484300 0 host=a \n" +
+			"put untagged 1505484300 0 host=default \n", 3, 2},
+		{Reject, "put ok 1505484300 0 host=a \n" +
+			"put untagged 1505484300 0 host=default \n", 1, 4},
+	} {
+		var buf bytes.Buffer
+		var result FlushResult
+		e := &TaggedOpenTSDB{
+			Writer:     &buf,
+			Registry:   newRegistry(),
+			Validation: &Validation{Policy: c.policy, MaxTags: 2, DefaultTags: Tags{"host": "default"}},
+			OnFlush:    func(r FlushResult) { result = r },
+			Logger:     log.New(),
+			Clock:      NewFakeClock(time.Unix(1505484300, 0)),
+		}
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+		if got := sortLines(buf.String()); got != c.expected {
+			t.Errorf("Policy %d, expected:\n%s\ngot:\n%s", c.policy, c.expected, got)
+		}
+		if result.Sanitized != c.sanitized || result.Invalid != c.invalid {
+			t.Errorf("Policy %d, expected %d sanitized and %d invalid, got %d and %d",
+				c.policy, c.sanitized, c.invalid, result.Sanitized, result.Invalid)
+		}
+	}
+}
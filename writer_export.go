@@ -0,0 +1,82 @@
+package tsdmetrics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// exportWriter writes the registry to t.Writer in t.Format.
+//
+// Tcollector and Json output is exactly what would be sent to OpenTSDB.
+// Uncompressed Json bulks are each followed by a newline. Writers with a
+// Flush method, like bufio.Writer or RotatingFile, are flushed at the end.
+func (t *TaggedOpenTSDB) exportWriter(now int64, stats *flushStats) error {
+	cw := &countingWriter{w: t.Writer}
+	defer func() { stats.bytes += cw.n }()
+
+	var err error
+	switch t.Format {
+	case Tcollector:
+		err = t.writeTcollector(cw, now, stats)
+	case Json:
+		compressed := t.compression() != NoCompression
+		encErr := t.encodeJSON(now, func(body *bytes.Buffer, points int) {
+			if err != nil {
+				return
+			}
+			if !compressed {
+				body.WriteByte('\n')
+			}
+			if _, err = body.WriteTo(cw); err == nil {
+				stats.points += int64(points)
+			}
+		})
+		if err == nil {
+			err = encErr
+		}
+	case JsonLines:
+		bw := bufio.NewWriter(cw)
+		enc := json.NewEncoder(bw)
+		t.eachJSONPoint(now, func(p *point) {
+			if err == nil {
+				if err = enc.Encode(p.openTSDBPoint()); err == nil {
+					stats.points++
+				}
+			}
+		})
+		if err == nil {
+			err = bw.Flush()
+		}
+	case Table:
+		err = t.writeTable(cw, now, stats)
+	default:
+		err = fmt.Errorf("Unsupported format: %d", t.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if f, ok := t.Writer.(interface {
+		Flush() error
+	}); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (t *TaggedOpenTSDB) writeTable(w *countingWriter, now int64, stats *flushStats) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tTIMESTAMP\tVALUE\tTAGS")
+
+	var tags []byte
+	t.eachJSONPoint(now, func(p *point) {
+		tags = appendTags(tags[:0], p.tags)
+		fmt.Fprintf(tw, "%s\t%d\t%v\t%s\n", p.Metric(), p.timestamp, p.Value(), strings.TrimSpace(string(tags)))
+		stats.points++
+	})
+	return tw.Flush()
+}
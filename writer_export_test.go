@@ -0,0 +1,130 @@
+package tsdmetrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestWriterExport(t *testing.T) {
+	r := NewTaggedRegistry()
+	g := metrics.NewGauge()
+	g.Update(42)
+	r.Register("test", Tags{"host": "a", "dc": "x"}, g)
+
+	var buf bytes.Buffer
+	e := &TaggedOpenTSDB{Writer: &buf, Registry: r, Logger: log.New(), Clock: NewFakeClock(time.Unix(1505484300, 0))}
+
+	for format, expected := range map[OpenTSDBFormat]string{
+		Tcollector: "put test 1505484300 42 dc=x host=a \n",
+		Json:       `[{"metric":"test","value":42,"timestamp":1505484300,"tags":{"dc":"x","host":"a"}}` + "\n]\n",
+		JsonLines:  `{"metric":"test","value":42,"timestamp":1505484300,"tags":{"dc":"x","host":"a"}}` + "\n",
+		Table:      "METRIC  TIMESTAMP   VALUE  TAGS\ntest    1505484300  42     dc=x host=a\n",
+	} {
+		buf.Reset()
+		e.Format = format
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expected {
+			t.Errorf("Format %d, expected:\n%q\ngot:\n%q", format, expected, buf.String())
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdmetrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metrics.json")
+	f, err := NewRotatingFile(path, 64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewTaggedRegistry()
+	r.Register("test", Tags{"host": "a"}, metrics.NewCounter())
+	e := &TaggedOpenTSDB{Writer: f, Registry: r, Format: JsonLines, Logger: log.New()}
+	for i := 0; i < 3; i++ {
+		if err := e.Export(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(path + "*")
+	if len(files) != 3 {
+		t.Fatalf("Expected 2 rotated files and the current one, got %v", files)
+	}
+	for _, name := range files {
+		b, _ := ioutil.ReadFile(name)
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var p OpenTSDBPoint
+			if err := json.Unmarshal([]byte(line), &p); err != nil {
+				t.Errorf("%s holds an invalid line %q: %s", name, line, err)
+			}
+		}
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdmetrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metrics.txt")
+	f, err := NewRotatingFile(path, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	clock := NewFakeClock(time.Date(2017, 9, 15, 14, 5, 0, 0, time.UTC))
+	f.Clock = clock
+
+	write := func() {
+		if _, err := f.Write([]byte("line\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write()
+	clock.Advance(30 * time.Second)
+	write()
+	if files, _ := filepath.Glob(path + ".*"); len(files) != 0 {
+		t.Errorf("Expected no rotation before MaxAge, got %v", files)
+	}
+
+	// A rotated name already taken by a directory makes the rename fail.
+	clock.Advance(30 * time.Second)
+	taken := path + ".20170915T140600.000000000"
+	if err := os.MkdirAll(filepath.Join(taken, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write()
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "line\nline\nline\n" {
+		t.Errorf("Expected writing to go on in the original file, got %q", b)
+	}
+
+	os.RemoveAll(taken)
+	write()
+	if b, _ := ioutil.ReadFile(taken); string(b) != "line\nline\nline\n" {
+		t.Errorf("Expected the file to be rotated once the name is free, got %q", b)
+	}
+}